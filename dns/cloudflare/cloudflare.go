@@ -3,6 +3,8 @@ package cloudflare
 import (
 	"errors"
 	cf "github.com/cloudflare/cloudflare-go"
+	dns "github.com/envoy/auto-spf-flattener/dns"
+	spf "github.com/envoy/auto-spf-flattener/spf"
 	"os"
 	"strings"
 )
@@ -45,6 +47,9 @@ type CloudflareAPI interface {
 //}
 
 // Implements dns.DNSAPI
+// Records longer than one TXT character-string are written as several quoted
+// strings and joined back together when read, so callers only ever see
+// whole records.
 type CloudflareAPIClient struct {
 	ZoneID string
 	Api    CloudflareAPI
@@ -80,26 +85,55 @@ func (c *CloudflareAPIClient) FilterTXTRecords(name, filter string) ([]string, e
 	}
 	results := []string{}
 	for _, record := range records {
-		if strings.Contains(record.Content, filter) {
+		if strings.Contains(spf.UnquoteTXT(record.Content), filter) {
 			results = append(results, record.ID)
 		}
 	}
 	return results, nil
 }
 
+// Every TXT record in the zone, implements dns.ZoneLister
+func (c *CloudflareAPIClient) ListTXTRecords() ([]dns.ZoneRecord, error) {
+	records, err := c.Api.DNSRecords(c.ZoneID, cf.DNSRecord{Type: "TXT"})
+	if err != nil {
+		return nil, err
+	}
+	results := []dns.ZoneRecord{}
+	for _, record := range records {
+		results = append(results, dns.ZoneRecord{
+			ID:       record.ID,
+			Name:     record.Name,
+			Content:  spf.UnquoteTXT(record.Content),
+			Modified: record.ModifiedOn,
+		})
+	}
+	return results, nil
+}
+
 func (c *CloudflareAPIClient) GetTXTRecordContent(id string) (string, error) {
 	if record, err := c.Api.DNSRecord(c.ZoneID, id); err != nil {
 		return "", err
 	} else {
-		return record.Content, nil
+		return spf.UnquoteTXT(record.Content), nil
+	}
+}
+
+// Implements dns.TTLReader, 1 is Cloudflare's automatic TTL
+func (c *CloudflareAPIClient) GetTXTRecordTTL(id string) (int, error) {
+	record, err := c.Api.DNSRecord(c.ZoneID, id)
+	if err != nil {
+		return 0, err
 	}
+	return record.TTL, nil
 }
 
-func (c *CloudflareAPIClient) WriteTXTRecord(name, txt string) (string, error) {
+// A ttl of 0 leaves it up to Cloudflare
+func (c *CloudflareAPIClient) WriteTXTRecord(name, txt string, ttl int) (string, error) {
 	rr := cf.DNSRecord{
 		Type:    "TXT",
 		Name:    name,
-		Content: txt,
+		Content: spf.QuoteTXT(txt),
+		TTL:     ttl,
 	}
 	response, err := c.Api.CreateDNSRecord(c.ZoneID, rr)
 	if err != nil {
@@ -113,11 +147,12 @@ func (c *CloudflareAPIClient) WriteTXTRecord(name, txt string) (string, error) {
 }
 
 // Update does not change the ID
-func (c *CloudflareAPIClient) UpdateTXTRecord(id, name, txt string) (string, error) {
+func (c *CloudflareAPIClient) UpdateTXTRecord(id, name, txt string, ttl int) (string, error) {
 	rr := cf.DNSRecord{
 		Type:    "TXT",
 		Name:    name,
-		Content: txt,
+		Content: spf.QuoteTXT(txt),
+		TTL:     ttl,
 	}
 	err := c.Api.UpdateDNSRecord(c.ZoneID, id, rr)
 	if err != nil {
@@ -4,7 +4,9 @@ import (
 	cf "github.com/cloudflare/cloudflare-go"
 	mock_cloudflare "github.com/envoy/auto-spf-flattener/dns/cloudflare/mock_cloudflare"
 	"github.com/golang/mock/gomock"
+	"strings"
 	"testing"
+	"time"
 )
 
 const TestZoneName = "my_zone"
@@ -52,6 +54,38 @@ func TestFilterTXTRecords(t *testing.T) {
 	}
 }
 
+func TestListTXTRecords(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	modified := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	response := []cf.DNSRecord{
+		cf.DNSRecord{
+			ID:         TestRecordID,
+			Type:       "TXT",
+			Name:       "_spfabc123." + TestDomain,
+			Content:    `"v=spf1 ip4:192.0.2.0/24" " ~all"`,
+			ModifiedOn: modified,
+		},
+	}
+
+	mockCloudflare := mock_cloudflare.NewMockCloudflareAPI(ctrl)
+	mockCloudflare.EXPECT().DNSRecords(TestZoneID, cf.DNSRecord{Type: "TXT"}).Return(response, nil)
+
+	client := &CloudflareAPIClient{
+		ZoneID: TestZoneID,
+		Api:    mockCloudflare,
+	}
+
+	records, err := client.ListTXTRecords()
+	if err != nil {
+		t.Errorf("Error listing TXT records: %s", err)
+	}
+	if len(records) != 1 || records[0].ID != TestRecordID || records[0].Content != "v=spf1 ip4:192.0.2.0/24 ~all" || !records[0].Modified.Equal(modified) {
+		t.Errorf("Wrong records listed: %v", records)
+	}
+}
+
 func TestGetTXTRecordContent(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -79,6 +113,34 @@ func TestGetTXTRecordContent(t *testing.T) {
 	}
 }
 
+func TestGetTXTRecordTTL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	response := cf.DNSRecord{
+		Type:    "TXT",
+		Name:    TestDomain,
+		Content: TestSPFTXT,
+		TTL:     3600,
+	}
+
+	mockCloudflare := mock_cloudflare.NewMockCloudflareAPI(ctrl)
+	mockCloudflare.EXPECT().DNSRecord(TestZoneID, TestRecordID).Return(response, nil)
+
+	client := &CloudflareAPIClient{
+		ZoneID: TestZoneID,
+		Api:    mockCloudflare,
+	}
+
+	ttl, err := client.GetTXTRecordTTL(TestRecordID)
+	if err != nil {
+		t.Errorf("Error getting TXT record TTL: %s", err)
+	}
+	if ttl != 3600 {
+		t.Errorf("Wrong TTL returned during fetch: %d", ttl)
+	}
+}
+
 func TestWriteTXT(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -105,7 +167,7 @@ func TestWriteTXT(t *testing.T) {
 		Api:    mockCloudflare,
 	}
 
-	id, err := client.WriteTXTRecord(TestDomain, TestSPFTXT)
+	id, err := client.WriteTXTRecord(TestDomain, TestSPFTXT, 0)
 	if err != nil {
 		t.Errorf("Error writing TXT record: %s", err)
 	}
@@ -122,6 +184,7 @@ func TestUpdateTXTRecord(t *testing.T) {
 		Type:    "TXT",
 		Name:    TestDomain,
 		Content: TestSPFTXT,
+		TTL:     300,
 	}
 
 	mockCloudflare := mock_cloudflare.NewMockCloudflareAPI(ctrl)
@@ -132,7 +195,7 @@ func TestUpdateTXTRecord(t *testing.T) {
 		Api:    mockCloudflare,
 	}
 
-	id, err := client.UpdateTXTRecord(TestRecordID, TestDomain, TestSPFTXT)
+	id, err := client.UpdateTXTRecord(TestRecordID, TestDomain, TestSPFTXT, 300)
 	if err != nil {
 		t.Errorf("Error deleting TXT record: %s", err)
 	}
@@ -158,3 +221,49 @@ func TestDeleteTXTRecord(t *testing.T) {
 		t.Errorf("Error deleting TXT record: %s", err)
 	}
 }
+
+func TestLongTXTRecords(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	long := "v=spf1 " + strings.Repeat("ip4:192.0.2.0/24 ", 20) + "-all"
+	quoted := `"` + long[:255] + `" "` + long[255:] + `"`
+
+	expectedRr := cf.DNSRecord{
+		Type:    "TXT",
+		Name:    TestDomain,
+		Content: quoted,
+	}
+	response := &cf.DNSRecordResponse{
+		Response: cf.Response{
+			Success: true,
+		},
+		Result: cf.DNSRecord{
+			ID: TestRecordID,
+		},
+	}
+	mockCloudflare := mock_cloudflare.NewMockCloudflareAPI(ctrl)
+	mockCloudflare.EXPECT().CreateDNSRecord(TestZoneID, expectedRr).Return(response, nil)
+	mockCloudflare.EXPECT().DNSRecords(TestZoneID, cf.DNSRecord{Type: "TXT", Name: TestDomain}).Return([]cf.DNSRecord{
+		cf.DNSRecord{ID: TestRecordID, Content: quoted},
+	}, nil)
+	mockCloudflare.EXPECT().DNSRecord(TestZoneID, TestRecordID).Return(cf.DNSRecord{Content: quoted}, nil)
+
+	client := &CloudflareAPIClient{
+		ZoneID: TestZoneID,
+		Api:    mockCloudflare,
+	}
+
+	if _, err := client.WriteTXTRecord(TestDomain, long, 0); err != nil {
+		t.Errorf("Error writing TXT record: %s", err)
+	}
+	// What was written has to match when looking for it again
+	ids, err := client.FilterTXTRecords(TestDomain, long)
+	if err != nil || len(ids) != 1 {
+		t.Errorf("Long record should match itself: %v %v", ids, err)
+	}
+	content, err := client.GetTXTRecordContent(TestRecordID)
+	if err != nil || content != long {
+		t.Errorf("Wrong content returned during fetch: `%s` %v", content, err)
+	}
+}
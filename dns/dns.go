@@ -1,20 +1,30 @@
 package dns
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	spf "github.com/envoy/auto-spf-flattener/spf"
+	"strings"
+	"time"
 )
 
 type DNSAPI interface {
 	FilterTXTRecords(string, string) ([]string, error)
 	GetTXTRecordContent(string) (string, error)
-	WriteTXTRecord(string, string) (string, error)
-	UpdateTXTRecord(string, string, string) (string, error)
+	// The TTL is in seconds, 0 for the provider's default
+	WriteTXTRecord(string, string, int) (string, error)
+	UpdateTXTRecord(string, string, string, int) (string, error)
 	DeleteTXTRecord(string) error
 }
 
+// DNS APIs that can tell the TTL of a record, so rolling back an update or
+// delete puts it back as it was rather than with the provider's default
+type TTLReader interface {
+	GetTXTRecordTTL(string) (int, error)
+}
+
 // simple printer implements DNSAPI
 type DNSPrinter struct{}
 
@@ -28,13 +38,13 @@ func (p *DNSPrinter) GetTXTRecordContent(id string) (string, error) {
 	return id, nil
 }
 
-func (p *DNSPrinter) WriteTXTRecord(name, txt string) (string, error) {
-	fmt.Printf("API->WriteTXTRecord(%s, `%s`)\n", name, txt)
+func (p *DNSPrinter) WriteTXTRecord(name, txt string, ttl int) (string, error) {
+	fmt.Printf("API->WriteTXTRecord(%s, `%s`, %d)\n", name, txt, ttl)
 	return name, nil
 }
 
-func (p *DNSPrinter) UpdateTXTRecord(id, name, txt string) (string, error) {
-	fmt.Printf("API->UpdateTXTRecord(%s, %s, `%s`)\n", id, name, txt)
+func (p *DNSPrinter) UpdateTXTRecord(id, name, txt string, ttl int) (string, error) {
+	fmt.Printf("API->UpdateTXTRecord(%s, %s, `%s`, %d)\n", id, name, txt, ttl)
 	return name, nil
 }
 
@@ -43,84 +53,395 @@ func (p *DNSPrinter) DeleteTXTRecord(id string) error {
 	return nil
 }
 
+// A DNS provider call that failed
+type APIError struct {
+	Call string
+	// Name the call was about
+	Name string
+	// Record the call was about, if any
+	ID  string
+	Err error
+}
+
+func (e *APIError) Error() string {
+	if e.ID != "" {
+		return fmt.Sprintf("%s of record %s at %s failed: %s", e.Call, e.ID, e.Name, e.Err)
+	}
+	return fmt.Sprintf("%s at %s failed: %s", e.Call, e.Name, e.Err)
+}
+
+// The SPF records in the zone couldn't all be read, so changing them
+// could leave duplicates or dangling includes behind
+type IncompleteReadError struct {
+	Domain string
+	Err    error
+}
+
+func (e *IncompleteReadError) Error() string {
+	return fmt.Sprintf("Refusing to change %s, its current SPF records cannot all be read: %s", e.Domain, e.Err)
+}
+
 type DnsUpdater struct {
 	Api                DNSAPI
 	topDomain          string
 	spfSubdomainPrefix string
+	// Refuse to update when the records to publish would authorize other
+	// addresses than the ideal record
+	Verify bool
+	// Largest DNS response a record may need, more than 512 only if every
+	// receiver uses EDNS0
+	ResponseSize int
+	// Flattened records are cached no longer than what they were flattened
+	// from, but within these bounds. 0 for no bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// When set, the top record only switches once every authoritative
+	// nameserver has the new subrecords, asked every PropagationInterval
+	Authorities         AuthorityQuerent
+	PropagationInterval time.Duration
+	// Old subrecords are queued here and deleted by a later run, once
+	// resolvers can't have the old top record cached anymore, and no sooner
+	// than DeleteDelay. When nil, a queue in memory is made.
+	Pending     *PendingDeletions
+	DeleteDelay time.Duration
+	// Delete orphaned subrecords after updating, once they haven't changed
+	// for GCGrace
+	GC      bool
+	GCGrace time.Duration
+	// Prefixes used before, whose subrecords are orphans too
+	GCPrefixes []string
+	// The clock, replaced in tests
+	now func() time.Time
 }
 
 type TXTRecord struct {
 	name string
 	txt  string
+	// In seconds, 0 for the provider's default
+	ttl int
 }
 
 func NewDNSUpdater(api DNSAPI, topDomain, spfSubdomainPrefix string) *DnsUpdater {
 	return &DnsUpdater{
-		Api:                api,
-		topDomain:          topDomain,
-		spfSubdomainPrefix: spfSubdomainPrefix,
+		Api:                 api,
+		topDomain:           topDomain,
+		spfSubdomainPrefix:  spfSubdomainPrefix,
+		ResponseSize:        spf.UDP_RESPONSE_SIZE,
+		MinTTL:              5 * time.Minute,
+		MaxTTL:              24 * time.Hour,
+		PropagationInterval: 5 * time.Second,
+		DeleteDelay:         5 * time.Minute,
+		GCGrace:             24 * time.Hour,
 	}
 }
 
-// Input is the preferred SPF regardless of DNS lookups and response size
-func (u *DnsUpdater) Update(ideal *spf.SPF, dryRun bool) error {
+// Input is the preferred SPF regardless of DNS lookups and response size.
+// DNS queries give up when the context is done.
+func (u *DnsUpdater) Update(ctx context.Context, ideal *spf.SPF, dryRun bool) error {
+	if err := u.deletePending(dryRun); err != nil {
+		return err
+	}
+	plan, err := u.Plan(ctx, ideal)
+	if err != nil {
+		return err
+	}
+	if len(plan.Changes) > 0 {
+		if err := u.updateDNS(ctx, plan, dryRun); err != nil {
+			return err
+		}
+	}
+	if u.GC {
+		return u.CollectGarbage(dryRun)
+	}
+	return nil
+}
 
-	flat, err := ideal.Flatten()
+// Applies a plan made earlier, unless the SPF records it was made from
+// have changed since
+func (u *DnsUpdater) Apply(ctx context.Context, plan *Plan) error {
+	if plan.Domain != u.topDomain {
+		return fmt.Errorf("Plan is for %s, not %s", plan.Domain, u.topDomain)
+	}
+	observed, err := u.precheck()
 	if err != nil {
 		return err
 	}
+	if err := drift(u.topDomain, plan.Observed, observed); err != nil {
+		return err
+	}
+	if err := u.deletePending(false); err != nil {
+		return err
+	}
+	return u.updateDNS(ctx, plan, false)
+}
+
+// Works out what to change without changing anything
+func (u *DnsUpdater) Plan(ctx context.Context, ideal *spf.SPF) (*Plan, error) {
+	if ideal.Domain == "" {
+		// a and mx without a domain-spec refer to the top domain
+		ideal.Domain = u.topDomain
+	}
+	observed, err := u.precheck()
+	if err != nil {
+		return nil, err
+	}
+
+	topBudget, published, err := u.topBudget()
+	if err != nil {
+		return nil, err
+	}
+	if len(published) > 1 {
+		multiple := &spf.MultipleRecordsError{Domain: u.topDomain, Records: published}
+		if ideal.MultipleRecordsPolicy == spf.MultipleRecordsFail {
+			return nil, multiple
+		}
+		fmt.Println("Warning: " + multiple.Error() + ", replacing them with one")
+	}
+
+	lookups, err := ideal.CountLookups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(lookups)
+	exceeded := lookups.Exceeded()
+	if !topBudget.Fits(ideal.AsTXTRecord()) {
+		exceeded = append(exceeded, fmt.Sprintf("a %d octet response, more than %d", topBudget.ResponseSize(ideal.AsTXTRecord()), topBudget.Size))
+	}
 
 	records := []TXTRecord{}
 	var topRecord TXTRecord
 
-	if flat.LookupCount <= 10 {
+	if len(exceeded) == 0 {
 		// No need for flattening
 		// var records remains empty
 		topRecord = TXTRecord{
 			name: u.topDomain,
 			txt:  ideal.AsTXTRecord(),
+			ttl:  u.publishTTL(lookups.TTL),
 		}
 	} else {
-		// Need to split it up
-		splits, err := flat.Split()
+		// Need to split it up, into as few networks as possible first
+		fmt.Println("Flattening the ideal record: " + strings.Join(exceeded, "; "))
+		flat, err := ideal.Flatten(ctx)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		for _, warning := range flat.Warnings {
+			fmt.Println("Warning: " + warning)
+		}
+		normal := flat.Clone()
+		if err := normal.Normalize(); err != nil {
+			return nil, err
+		}
+		// Subdomain names all have the same length, whatever their hash
+		subBudget := spf.NewResponseBudget(u.spfSubdomainPrefix + hash("") + "." + u.topDomain)
+		subBudget.Size = u.ResponseSize
+		splits, err := normal.Split(subBudget)
+		if err != nil {
+			return nil, err
+		}
+		if len(splits) > spf.MAX_LOOKUPS {
+			return nil, fmt.Errorf("Flattened record needs %d includes, more than the limit of %d lookups", len(splits), spf.MAX_LOOKUPS)
+		}
+		records, topRecord = u.makeRecords(flat, splits)
+		if !topBudget.Fits(topRecord.txt) {
+			return nil, fmt.Errorf("Top record needs a %d octet response, more than %d", topBudget.ResponseSize(topRecord.txt), topBudget.Size)
+		}
+		// Published as is otherwise, which has nothing to verify
+		if u.Verify {
+			if err := u.verify(ctx, ideal, flat, topRecord, records); err != nil {
+				return nil, err
+			}
 		}
-		records, topRecord = u.makeRecords(splits)
+	}
+	// Only left when the fallback answered instead
+	for _, disagreement := range spf.Disagreements(ideal.Querent) {
+		fmt.Println("Warning: " + disagreement.Error())
 	}
 
-	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete := u.getCurrentRecordIDs(topRecord)
+	plan := &Plan{
+		Domain:   u.topDomain,
+		Created:  time.Now().UTC(),
+		Observed: observed,
+		Changes:  []Change{},
+	}
+	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete, err := u.getCurrentRecordIDs(topRecord)
+	if err != nil {
+		return nil, err
+	}
 	if !shouldUpdate {
-		// all done here
-		return nil
+		return plan, nil
 	}
 
-	return u.updateDNS(topRecordIDToUpdate, topRecord, records, recordIDsToDelete, dryRun)
+	contents := map[string]ObservedRecord{}
+	for _, record := range observed {
+		contents[record.ID] = record
+	}
+	// 1. Create new subdomain records
+	for _, record := range records {
+		plan.Changes = append(plan.Changes, Change{Action: ActionCreate, Name: record.name, After: record.txt, TTL: record.ttl})
+	}
+	// 2. Update or create top record
+	if topRecordIDToUpdate == "" {
+		plan.Changes = append(plan.Changes, Change{Action: ActionCreate, Name: topRecord.name, After: topRecord.txt, TTL: topRecord.ttl})
+	} else {
+		plan.Changes = append(plan.Changes, Change{
+			Action:    ActionUpdate,
+			ID:        topRecordIDToUpdate,
+			Name:      topRecord.name,
+			Before:    contents[topRecordIDToUpdate].Content,
+			After:     topRecord.txt,
+			TTL:       topRecord.ttl,
+			BeforeTTL: contents[topRecordIDToUpdate].TTL,
+		})
+	}
+	// 3. Delete any old top or sub records
+	for _, id := range recordIDsToDelete {
+		old := contents[id]
+		plan.Changes = append(plan.Changes, Change{Action: ActionDelete, ID: id, Name: old.Name, Before: old.Content, BeforeTTL: old.TTL})
+	}
+	return plan, nil
 }
 
 // Returns a slice of subdomain records and one top-level record, which
-// references them.
-func (u *DnsUpdater) makeRecords(splits []*spf.SPF) ([]TXTRecord, TXTRecord) {
+// references them along with the all mechanism and modifiers of flat.
+func (u *DnsUpdater) makeRecords(flat *spf.SPF, splits []*spf.SPF) ([]TXTRecord, TXTRecord) {
 	records := []TXTRecord{}
+	ttl := u.publishTTL(flat.TTL)
 
 	topSPF := spf.NewSPF()
-	topSPF.AllRune = splits[0].AllRune
 
 	for _, split := range splits {
-		txt := split.AsTXTRecord()
+		sub, qualifier := split.Subrecord()
+		txt := sub.AsTXTRecord()
 		sig := hash(txt)
 		subdomain := u.spfSubdomainPrefix + sig
 		record := TXTRecord{
 			name: subdomain,
 			txt:  txt,
+			ttl:  ttl,
 		}
 		records = append(records, record)
-		topSPF.Include = append(topSPF.Include, subdomain+"."+u.topDomain)
+		include := spf.NewTerm(qualifier, spf.KindInclude, subdomain+"."+u.topDomain)
+		topSPF.Terms = append(topSPF.Terms, include)
+	}
+	for _, term := range flat.Terms {
+		if term.Kind == spf.KindAll || !term.Kind.IsMechanism() {
+			topSPF.Terms = append(topSPF.Terms, term)
+		}
 	}
 	return records, TXTRecord{
 		name: u.topDomain,
 		txt:  topSPF.AsTXTRecord(),
+		ttl:  ttl,
+	}
+}
+
+// The TTL in seconds to publish records flattened from answers with the
+// given lowest TTL. Unknown TTLs leave it to the provider.
+func (u *DnsUpdater) publishTTL(ttl time.Duration) int {
+	if ttl == 0 {
+		return 0
 	}
+	if u.MinTTL > 0 && ttl < u.MinTTL {
+		ttl = u.MinTTL
+	}
+	if u.MaxTTL > 0 && ttl > u.MaxTTL {
+		ttl = u.MaxTTL
+	}
+	return int(ttl / time.Second)
+}
+
+// Checks that the records about to be published give every address the same
+// result the ideal record does
+func (u *DnsUpdater) verify(ctx context.Context, ideal, flat *spf.SPF, topRecord TXTRecord, records []TXTRecord) error {
+	overlay := &spf.OverlayQuerent{
+		TXT:     map[string][]string{},
+		Querent: ideal.Querent,
+	}
+	for _, record := range records {
+		overlay.TXT[record.name+"."+u.topDomain] = []string{record.txt}
+	}
+
+	published := spf.NewSPF()
+	if err := published.Parse(topRecord.txt); err != nil {
+		return err
+	}
+	published.Domain = u.topDomain
+	published.Querent = overlay
+	published.ParseErrorPolicy = ideal.ParseErrorPolicy
+	publishedFlat, err := published.Flatten(ctx)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := spf.Diff(flat, publishedFlat)
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		fmt.Println("Difference: " + diff.String())
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("Records to publish differ from the ideal record in %d networks", len(diffs))
+	}
+	return nil
+}
+
+// The response budget at the top domain, which has to leave room for the
+// TXT records other than SPF published there. Also returns the SPF records
+// published there now.
+func (u *DnsUpdater) topBudget() (*spf.ResponseBudget, []string, error) {
+	budget := spf.NewResponseBudget(u.topDomain)
+	budget.Size = u.ResponseSize
+	published := []string{}
+	ids, err := u.filterTXTRecords(u.topDomain, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		content, err := u.getTXTRecordContent(id, u.topDomain)
+		if err != nil {
+			return nil, nil, err
+		}
+		if spf.IsSPF(content) {
+			published = append(published, content)
+		} else {
+			budget.OtherTXT = append(budget.OtherTXT, content)
+		}
+	}
+	return budget, published, nil
+}
+
+// FilterTXTRecords, with errors saying what was asked
+func (u *DnsUpdater) filterTXTRecords(name, filter string) ([]string, error) {
+	ids, err := u.Api.FilterTXTRecords(name, filter)
+	if err != nil {
+		return nil, &APIError{Call: "FilterTXTRecords", Name: name, Err: err}
+	}
+	return ids, nil
+}
+
+// GetTXTRecordContent, with errors saying what was asked
+func (u *DnsUpdater) getTXTRecordContent(id, name string) (string, error) {
+	content, err := u.Api.GetTXTRecordContent(id)
+	if err != nil {
+		return "", &APIError{Call: "GetTXTRecordContent", Name: name, ID: id, Err: err}
+	}
+	return content, nil
+}
+
+// GetTXTRecordTTL when the API has it, 0 for the provider's default otherwise
+func (u *DnsUpdater) getTXTRecordTTL(id, name string) (int, error) {
+	reader, ok := u.Api.(TTLReader)
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := reader.GetTXTRecordTTL(id)
+	if err != nil {
+		return 0, &APIError{Call: "GetTXTRecordTTL", Name: name, ID: id, Err: err}
+	}
+	return ttl, nil
 }
 
 func hash(txt string) string {
@@ -128,72 +449,92 @@ func hash(txt string) string {
 	return hex.EncodeToString(sum[0:3])
 }
 
-func (u *DnsUpdater) updateDNS(topRecordIDToUpdate string, topRecord TXTRecord, newRecords []TXTRecord, recordIDsToDelete []string, dryRun bool) error {
-	// Need to add new records as well as delete the old ones
-	// 1. Create new subdomain records
-	// 2. Update or create top record
-	// 3. Delete any old top or sub records
-
+// Makes the changes in order. New subrecords have to reach every
+// authoritative nameserver before the top record switches to them, and old
+// subrecords are queued for deletion, never deleted right away. When a change
+// fails, the ones before it are undone and a *RollbackError reports what
+// was rolled back.
+func (u *DnsUpdater) updateDNS(ctx context.Context, plan *Plan, dryRun bool) error {
 	// Always print what we're modifying
 	printer := &DNSPrinter{}
-
-	// 1.
-	for _, record := range newRecords {
-		printer.WriteTXTRecord(record.name, record.txt)
-		if !dryRun {
-			_, err := u.Api.WriteTXTRecord(record.name, record.txt)
-			if err != nil {
-				return err
-			}
-		}
+	journal := &journal{api: u.Api}
+	created := []Change{}
+	queued := []PendingDeletion{}
+	var deleteAfter time.Time
+	if u.Pending == nil {
+		// Later updates by this updater delete them, or gc once it's gone
+		u.Pending, _ = LoadPendingDeletions("")
 	}
 
-	// 2.
-	if topRecordIDToUpdate == "" {
-		printer.WriteTXTRecord(topRecord.name, topRecord.txt)
-		if !dryRun {
-			_, err := u.Api.WriteTXTRecord(topRecord.name, topRecord.txt)
-			if err != nil {
-				return err
+	for _, change := range plan.Changes {
+		top := change.Name == u.topDomain
+		if top && change.Action != ActionDelete && len(created) > 0 && u.Authorities != nil {
+			fmt.Printf("Waiting for %d new records to reach every authoritative nameserver\n", len(created))
+			if !dryRun {
+				if err := u.waitForPropagation(ctx, created); err != nil {
+					return journal.rollback(change, err)
+				}
 			}
+			created = nil
 		}
-	} else {
-		printer.UpdateTXTRecord(topRecordIDToUpdate, topRecord.name, topRecord.txt)
-		if !dryRun {
-			_, err := u.Api.UpdateTXTRecord(topRecordIDToUpdate, topRecord.name, topRecord.txt)
-			if err != nil {
-				return err
-			}
+		if top && change.Action != ActionDelete {
+			// Before the switch, while the TTL is still the old one's
+			deleteAfter = u.Pending.clock().Add(u.deleteDelay(ctx))
+		}
+		if !top && change.Action == ActionDelete {
+			deletion := PendingDeletion{ID: change.ID, Name: change.Name, Content: change.Before, NotBefore: deleteAfter}
+			fmt.Println("Deleting later: " + deletion.String())
+			queued = append(queued, deletion)
+			continue
 		}
-	}
 
-	// 3.
-	for _, oldID := range recordIDsToDelete {
-		printer.DeleteTXTRecord(oldID)
-		if !dryRun {
-			err := u.Api.DeleteTXTRecord(oldID)
-			if err != nil {
-				return err
-			}
+		if _, err := applyChange(printer, change); err != nil {
+			return err
+		}
+		if dryRun {
+			continue
+		}
+		if err := journal.apply(change); err != nil {
+			return journal.rollback(change, err)
+		}
+		if !top && change.Action == ActionCreate {
+			created = append(created, change)
 		}
 	}
 
-	return nil
+	if dryRun || len(queued) == 0 {
+		return nil
+	}
+	// Only once nothing will be rolled back, which could bring them back
+	// into use
+	u.Pending.Deletions = append(u.Pending.Deletions, queued...)
+	if u.Pending.Path == "" {
+		fmt.Printf("Warning: %d old subrecords are only queued in memory, left to gc if this process ends first\n", len(queued))
+	}
+	return u.Pending.Save()
 }
 
-// Look at the current DNS settings and figure out what needs to change
-func (u *DnsUpdater) getCurrentRecordIDs(topRecord TXTRecord) (bool, string, []string) {
+// Look at the current DNS settings and figure out what needs to change.
+// Any provider call failing fails the whole lookup, an unreadable zone
+// must never look like an empty one.
+func (u *DnsUpdater) getCurrentRecordIDs(topRecord TXTRecord) (bool, string, []string, error) {
 	var topRecordIDToUpdate string
 	var recordIDsToDelete []string = []string{}
 
-	allTopRecordIDs, _ := u.Api.FilterTXTRecords(u.topDomain, "v=spf1")
+	allTopRecordIDs, err := u.filterTXTRecords(u.topDomain, "v=spf1")
+	if err != nil {
+		return false, "", nil, err
+	}
 	if len(allTopRecordIDs) == 0 {
 		// no top record found, can't really do anything
 		// still need to add new DNS records
-		return true, topRecordIDToUpdate, recordIDsToDelete
+		return true, topRecordIDToUpdate, recordIDsToDelete, nil
 	}
 
-	goodTopRecordIDs, _ := u.Api.FilterTXTRecords(u.topDomain, topRecord.txt)
+	goodTopRecordIDs, err := u.filterTXTRecords(u.topDomain, topRecord.txt)
+	if err != nil {
+		return false, "", nil, err
+	}
 	var goodTopRecordID string
 	if len(goodTopRecordIDs) > 0 {
 		// It's possible that multiple match. Let the others get deleted.
@@ -202,24 +543,31 @@ func (u *DnsUpdater) getCurrentRecordIDs(topRecord TXTRecord) (bool, string, []s
 
 	if len(allTopRecordIDs) == 1 && allTopRecordIDs[0] == goodTopRecordID {
 		// Everything is correct, so do nothing!
-		return false, topRecordIDToUpdate, recordIDsToDelete
+		return false, topRecordIDToUpdate, recordIDsToDelete, nil
 	}
 
 	for _, topRecordID := range allTopRecordIDs {
+		content, err := u.getTXTRecordContent(topRecordID, u.topDomain)
+		if err != nil {
+			return false, "", nil, err
+		}
 		if topRecordIDToUpdate == "" {
 			topRecordIDToUpdate = topRecordID
 		} else {
+			// Only one SPF record is allowed
 			recordIDsToDelete = append(recordIDsToDelete, topRecordID)
+			fmt.Printf("Deleting extra SPF record %s at %s: `%s`\n", topRecordID, u.topDomain, content)
 		}
-		if content, err := u.Api.GetTXTRecordContent(topRecordID); err == nil {
-			topSPF := spf.NewSPF()
-			if topSPF.Parse(content) == nil {
-				for _, include := range topSPF.Include {
-					subRecordIDs, _ := u.Api.FilterTXTRecords(include, "v=spf1")
-					recordIDsToDelete = append(recordIDsToDelete, subRecordIDs...)
+		topSPF := spf.NewSPF()
+		if topSPF.Parse(content) == nil {
+			for _, include := range topSPF.Values(spf.KindInclude) {
+				subRecordIDs, err := u.filterTXTRecords(include, "v=spf1")
+				if err != nil {
+					return false, "", nil, err
 				}
+				recordIDsToDelete = append(recordIDsToDelete, subRecordIDs...)
 			}
 		}
 	}
-	return true, topRecordIDToUpdate, recordIDsToDelete
+	return true, topRecordIDToUpdate, recordIDsToDelete, nil
 }
@@ -1,10 +1,14 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	spf "github.com/envoy/auto-spf-flattener/spf"
 	"github.com/golang/mock/gomock"
 	"testing"
+	"time"
 )
 
 const TestDomain = "example.com"
@@ -34,7 +38,10 @@ func TestGetCurrentRecordIDs_NoChange(t *testing.T) {
 		topDomain: TestDomain,
 	}
 
-	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete := u.getCurrentRecordIDs(topRecord)
+	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete, err := u.getCurrentRecordIDs(topRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if shouldUpdate {
 		t.Error("Should not need to update")
@@ -61,7 +68,10 @@ func TestGetCurrentRecordIDs_AllNew(t *testing.T) {
 		topDomain: TestDomain,
 	}
 
-	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete := u.getCurrentRecordIDs(topRecord)
+	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete, err := u.getCurrentRecordIDs(topRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !shouldUpdate {
 		t.Error("Should need to update")
@@ -93,7 +103,10 @@ func TestGetCurrentRecordIDs_Replace(t *testing.T) {
 		topDomain: TestDomain,
 	}
 
-	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete := u.getCurrentRecordIDs(topRecord)
+	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete, err := u.getCurrentRecordIDs(topRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !shouldUpdate {
 		t.Error("Should need to update")
@@ -135,7 +148,10 @@ func TestGetCurrentRecordIDs_MultipleTops(t *testing.T) {
 		topDomain: TestDomain,
 	}
 
-	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete := u.getCurrentRecordIDs(topRecord)
+	shouldUpdate, topRecordIDToUpdate, recordIDsToDelete, err := u.getCurrentRecordIDs(topRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !shouldUpdate {
 		t.Error("Should need to update")
@@ -148,3 +164,130 @@ func TestGetCurrentRecordIDs_MultipleTops(t *testing.T) {
 		t.Errorf("Should set to delete three ids, instead got %v", recordIDsToDelete)
 	}
 }
+
+func TestGetCurrentRecordIDs_ListFails(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{}, errors.New("503 Service Unavailable"))
+
+	u := &DnsUpdater{
+		Api:       mockDNSAPI,
+		topDomain: TestDomain,
+	}
+
+	// An outage must not look like a zone without SPF records
+	shouldUpdate, _, _, err := u.getCurrentRecordIDs(TXTRecord{name: TestDomain, txt: TestTopSPFTXT})
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Call != "FilterTXTRecords" || apiErr.Name != TestDomain || shouldUpdate {
+		t.Errorf("Should fail listing %s, instead got %v", TestDomain, err)
+	}
+}
+
+func TestGetCurrentRecordIDs_ReadFails(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, TestIdealTXT).Return([]string{}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent(TestTopID).Return("", errors.New("timeout"))
+
+	u := &DnsUpdater{
+		Api:       mockDNSAPI,
+		topDomain: TestDomain,
+	}
+
+	_, _, _, err := u.getCurrentRecordIDs(TXTRecord{name: TestDomain, txt: TestIdealTXT})
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Call != "GetTXTRecordContent" || apiErr.ID != TestTopID {
+		t.Errorf("Should fail reading %s, instead got %v", TestTopID, err)
+	}
+}
+
+func TestUpdate_MultipleTops(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "").Return([]string{"Top1", "Other", "Top2"}, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{"Top1", "Top2"}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent("Top1").Return("v=spf1 ip4:192.0.2.0/24 -all", nil).Times(2)
+	mockDNSAPI.EXPECT().GetTXTRecordContent("Other").Return("verification=abc", nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent("Top2").Return("v=spf1 ~all", nil).Times(2)
+
+	ideal := spf.NewSPF()
+	ideal.Parse("v=spf1 ip4:192.0.2.0/24 -all")
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	err := u.Update(context.Background(), ideal, true)
+	if multiple, ok := err.(*spf.MultipleRecordsError); !ok || len(multiple.Records) != 2 {
+		t.Errorf("Should refuse to replace two SPF records: %v", err)
+	}
+}
+
+func TestMakeRecords(t *testing.T) {
+	flat := spf.NewSPF()
+	flat.Parse("v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.0/24 ~all exp=explain.example.com")
+	splits, err := flat.Split(spf.NewResponseBudget("_spfabcdef." + TestDomain))
+	if err != nil {
+		t.Fatalf("Error during split: %s", err)
+	}
+
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	records, topRecord := u.makeRecords(flat, splits)
+
+	if len(records) != 2 {
+		t.Fatalf("Should make a record per qualifier: %v", records)
+	}
+	if records[0].txt != "v=spf1 ip4:192.0.2.0/24 -all" || records[1].txt != "v=spf1 ip4:198.51.100.0/24 -all" {
+		t.Errorf("Subrecords should only pass: %v", records)
+	}
+	expected := fmt.Sprintf("v=spf1 include:%s.%s -include:%s.%s ~all exp=explain.example.com",
+		records[0].name, TestDomain, records[1].name, TestDomain)
+	if topRecord.name != TestDomain || topRecord.txt != expected {
+		t.Errorf("Wrong top record: %v", topRecord)
+	}
+}
+
+func TestPublishTTL(t *testing.T) {
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	cases := map[time.Duration]int{
+		0:                  0,
+		30 * time.Second:   300,
+		time.Hour:          3600,
+		7 * 24 * time.Hour: 86400,
+	}
+	for ttl, expected := range cases {
+		if got := u.publishTTL(ttl); got != expected {
+			t.Errorf("Wrong TTL for %s: %d instead of %d", ttl, got, expected)
+		}
+	}
+
+	flat := spf.NewSPF()
+	flat.Parse("v=spf1 ip4:192.0.2.0/24 -all")
+	flat.TTL = 20 * time.Minute
+	splits, _ := flat.Split(spf.NewResponseBudget("_spfabcdef." + TestDomain))
+	records, topRecord := u.makeRecords(flat, splits)
+	if records[0].ttl != 1200 || topRecord.ttl != 1200 {
+		t.Errorf("Records should have the TTL of the answers: %v %v", records, topRecord)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ideal := spf.NewSPF()
+	ideal.Parse("v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.0/24 ip6:2001:db8::/32 ~all")
+	flat, _ := ideal.Flatten(context.Background())
+	splits, _ := flat.Split(spf.NewResponseBudget("_spfabcdef." + TestDomain))
+
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	records, topRecord := u.makeRecords(flat, splits)
+	if err := u.verify(context.Background(), ideal, flat, topRecord, records); err != nil {
+		t.Errorf("Records should match the ideal: %s", err)
+	}
+
+	records[1].txt = "v=spf1 ip4:198.51.100.0/25 -all"
+	if err := u.verify(context.Background(), ideal, flat, topRecord, records); err == nil {
+		t.Error("Verify should notice the missing network")
+	}
+}
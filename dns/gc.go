@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A TXT record as a zone listing has it
+type ZoneRecord struct {
+	ID      string
+	Name    string
+	Content string
+	// When the record was created or last changed
+	Modified time.Time
+}
+
+// DNS APIs that can list every TXT record in the zone, which finding
+// orphaned subrecords needs
+type ZoneLister interface {
+	ListTXTRecords() ([]ZoneRecord, error)
+}
+
+// Whether name is one of the subrecords this updater makes, or made with
+// one of GCPrefixes, whatever the record it was made from
+func (u *DnsUpdater) managed(name string) bool {
+	for _, prefix := range append([]string{u.spfSubdomainPrefix}, u.GCPrefixes...) {
+		if prefix != "" && u.subrecordOf(prefix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *DnsUpdater) subrecordOf(prefix, name string) bool {
+	suffix := "." + u.topDomain
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return false
+	}
+	digest := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+	if len(digest) != len(hash("")) {
+		return false
+	}
+	for _, c := range digest {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Subrecords under the prefix or GCPrefixes that no SPF record at the top
+// domain includes, left behind by runs that crashed, hand edits of the top
+// record or an earlier prefix
+func (u *DnsUpdater) Orphans() ([]ZoneRecord, error) {
+	lister, ok := u.Api.(ZoneLister)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot list the records of a zone", u.Api)
+	}
+	records, err := lister.ListTXTRecords()
+	if err != nil {
+		return nil, &APIError{Call: "ListTXTRecords", Name: u.topDomain, Err: err}
+	}
+	included, err := u.includedNames()
+	if err != nil {
+		return nil, &IncompleteReadError{Domain: u.topDomain, Err: err}
+	}
+	orphans := []ZoneRecord{}
+	for _, record := range records {
+		if u.managed(record.Name) && strings.HasPrefix(record.Content, "v=spf1") && !included[record.Name] {
+			orphans = append(orphans, record)
+		}
+	}
+	return orphans, nil
+}
+
+// Deletes the orphaned subrecords that haven't changed for GCGrace, so
+// ones a run is still publishing are left alone. Ones already queued for
+// deletion are left to the queue.
+func (u *DnsUpdater) CollectGarbage(dryRun bool) error {
+	orphans, err := u.Orphans()
+	if err != nil {
+		return err
+	}
+	queued := map[string]bool{}
+	if u.Pending != nil {
+		for _, deletion := range u.Pending.Deletions {
+			queued[deletion.ID] = true
+		}
+	}
+
+	now := u.clock()
+	printer := &DNSPrinter{}
+	failed := []string{}
+	for _, orphan := range orphans {
+		age := now.Sub(orphan.Modified).Truncate(time.Second)
+		switch {
+		case queued[orphan.ID]:
+			fmt.Printf("Orphaned %s (%s) is queued for deletion already\n", orphan.Name, orphan.ID)
+			continue
+		case age < u.GCGrace:
+			fmt.Printf("Keeping orphaned %s (%s), it changed %s ago\n", orphan.Name, orphan.ID, age)
+			continue
+		}
+		fmt.Printf("Deleting orphaned %s (%s), unchanged for %s: `%s`\n", orphan.Name, orphan.ID, age, orphan.Content)
+		printer.DeleteTXTRecord(orphan.ID)
+		if dryRun {
+			continue
+		}
+		if err := u.Api.DeleteTXTRecord(orphan.ID); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s): %s", orphan.Name, orphan.ID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Cannot delete %d orphaned records: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (u *DnsUpdater) clock() time.Time {
+	if u.now == nil {
+		return time.Now()
+	}
+	return u.now()
+}
@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"errors"
+	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+// A DNS API that can list its zone
+type listingDNSAPI struct {
+	*mock_dns.MockDNSAPI
+	records []ZoneRecord
+	err     error
+}
+
+func (a *listingDNSAPI) ListTXTRecords() ([]ZoneRecord, error) {
+	return a.records, a.err
+}
+
+func TestManaged(t *testing.T) {
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	for name, expected := range map[string]bool{
+		"_spfabc123.example.com":     true,
+		"_spf.example.com":           false,
+		"_spfABCDEF.example.com":     false,
+		"_spfabc123.example.net":     false,
+		"_spfabc1234.example.com":    false,
+		"_spfabc123.sub.example.com": false,
+		"_dmarcabc12.example.com":    false,
+	} {
+		if u.managed(name) != expected {
+			t.Errorf("%s should be managed: %v", name, expected)
+		}
+	}
+}
+
+func TestManaged_EarlierPrefixes(t *testing.T) {
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	if u.managed("_oldspfabc123.example.com") {
+		t.Error("Subrecords of other prefixes shouldn't be managed")
+	}
+	u.GCPrefixes = []string{"_oldspf", "_flat"}
+	for _, name := range []string{"_spfabc123.example.com", "_oldspfabc123.example.com", "_flatabc123.example.com"} {
+		if !u.managed(name) {
+			t.Errorf("%s should be managed", name)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	topSPFTXT := "v=spf1 include:_spfaaaaaa.example.com ~all"
+	api := &listingDNSAPI{
+		MockDNSAPI: mock_dns.NewMockDNSAPI(ctrl),
+		records: []ZoneRecord{
+			{TestTopID, TestDomain, topSPFTXT, now.Add(-48 * time.Hour)},
+			{"Live", "_spfaaaaaa.example.com", "v=spf1 ip4:192.0.2.0/24 ~all", now.Add(-48 * time.Hour)},
+			{"Old", "_spfbbbbbb.example.com", "v=spf1 ip4:198.51.100.0/24 ~all", now.Add(-48 * time.Hour)},
+			{"New", "_spfcccccc.example.com", "v=spf1 ip4:203.0.113.0/24 ~all", now.Add(-time.Hour)},
+			{"Queued", "_spfdddddd.example.com", "v=spf1 ip4:203.0.113.0/24 ~all", now.Add(-48 * time.Hour)},
+			{"Other", "_spfeeeeee.example.com", "google-site-verification=abc", now.Add(-48 * time.Hour)},
+			{"Vendor", "_spf.example.com", "v=spf1 ip4:192.0.2.0/24 ~all", now.Add(-48 * time.Hour)},
+			{"Earlier", "_oldspfffffff.example.com", "v=spf1 ip4:192.0.2.0/24 ~all", now.Add(-48 * time.Hour)},
+		},
+	}
+	api.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil).Times(2)
+	api.EXPECT().GetTXTRecordContent(TestTopID).Return(topSPFTXT, nil).Times(2)
+
+	u := NewDNSUpdater(api, TestDomain, "_spf")
+	u.now = func() time.Time { return now }
+	u.Pending = &PendingDeletions{Deletions: []PendingDeletion{{ID: "Queued"}}}
+	u.GCPrefixes = []string{"_oldspf"}
+
+	orphans, err := u.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 4 || orphans[0].ID != "Old" || orphans[1].ID != "New" || orphans[2].ID != "Queued" || orphans[3].ID != "Earlier" {
+		t.Errorf("Should find four orphans, instead got %v", orphans)
+	}
+
+	// Only the ones past the grace period that aren't queued already
+	api.EXPECT().DeleteTXTRecord("Old").Return(nil)
+	api.EXPECT().DeleteTXTRecord("Earlier").Return(nil)
+	if err := u.CollectGarbage(false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectGarbage_DryRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := &listingDNSAPI{
+		MockDNSAPI: mock_dns.NewMockDNSAPI(ctrl),
+		records:    []ZoneRecord{{"Old", "_spfbbbbbb.example.com", "v=spf1 ~all", time.Time{}}},
+	}
+	api.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{}, nil)
+
+	// Nothing is deleted
+	if err := NewDNSUpdater(api, TestDomain, "_spf").CollectGarbage(true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectGarbage_Unreadable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	api := &listingDNSAPI{
+		MockDNSAPI: mock_dns.NewMockDNSAPI(ctrl),
+		records:    []ZoneRecord{{"Old", "_spfbbbbbb.example.com", "v=spf1 ~all", time.Time{}}},
+	}
+	api.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return(nil, errors.New("timeout"))
+
+	// Without the top record everything would look orphaned
+	err := NewDNSUpdater(api, TestDomain, "_spf").CollectGarbage(false)
+	if _, ok := err.(*IncompleteReadError); !ok {
+		t.Errorf("Should refuse to delete anything, instead got %v", err)
+	}
+
+	if _, err := NewDNSUpdater(api.MockDNSAPI, TestDomain, "_spf").Orphans(); err == nil {
+		t.Error("Should need an API that lists the zone")
+	}
+}
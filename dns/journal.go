@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Makes one change, returning the ID of the record a create made
+func applyChange(api DNSAPI, change Change) (string, error) {
+	switch change.Action {
+	case ActionCreate:
+		return api.WriteTXTRecord(change.Name, change.After, change.TTL)
+	case ActionUpdate:
+		_, err := api.UpdateTXTRecord(change.ID, change.Name, change.After, change.TTL)
+		return change.ID, err
+	case ActionDelete:
+		return change.ID, api.DeleteTXTRecord(change.ID)
+	}
+	return "", fmt.Errorf("Unknown change %s", change.Action)
+}
+
+// The changes made so far, so they can be undone when a later one fails
+type journal struct {
+	api DNSAPI
+	// The inverse of every change made, in the order made
+	undos []Change
+}
+
+func (j *journal) apply(change Change) error {
+	id, err := applyChange(j.api, change)
+	if err != nil {
+		return err
+	}
+	undo := Change{ID: change.ID, Name: change.Name, Before: change.After, After: change.Before, TTL: change.BeforeTTL, BeforeTTL: change.TTL}
+	switch change.Action {
+	case ActionCreate:
+		undo.Action = ActionDelete
+		undo.ID = id
+	case ActionUpdate:
+		undo.Action = ActionUpdate
+	case ActionDelete:
+		// Recreated under a new ID
+		undo.Action = ActionCreate
+		undo.ID = ""
+	}
+	j.undos = append(j.undos, undo)
+	return nil
+}
+
+// Undoes the changes made in reverse order, so the top record points at
+// its old subrecords again before the new ones go away
+func (j *journal) rollback(failed Change, cause error) *RollbackError {
+	rollback := &RollbackError{Failed: failed, Err: cause}
+	printer := &DNSPrinter{}
+	for i := len(j.undos) - 1; i >= 0; i-- {
+		undo := j.undos[i]
+		var err error
+		if undo.Action != ActionDelete && undo.After == "" {
+			err = fmt.Errorf("Previous content of %s unknown", undo.Name)
+		} else {
+			applyChange(printer, undo)
+			_, err = applyChange(j.api, undo)
+		}
+		if err != nil {
+			rollback.Stuck = append(rollback.Stuck, UndoFailure{undo, err})
+		} else {
+			rollback.RolledBack = append(rollback.RolledBack, undo)
+		}
+	}
+	j.undos = nil
+	return rollback
+}
+
+// A change failed after others were made. Those were undone, in reverse
+// order, as far as possible.
+type RollbackError struct {
+	Failed Change
+	Err    error
+	// Changes made to undo the earlier ones, in the order made
+	RolledBack []Change
+	// Undos that failed too, leaving their change in the zone
+	Stuck []UndoFailure
+}
+
+type UndoFailure struct {
+	Undo Change
+	Err  error
+}
+
+func (e *RollbackError) Error() string {
+	lines := []string{fmt.Sprintf("Cannot %s: %s", e.Failed, e.Err)}
+	if len(e.RolledBack) > 0 {
+		lines = append(lines, fmt.Sprintf("Rolled back %d changes:", len(e.RolledBack)))
+		for _, undo := range e.RolledBack {
+			lines = append(lines, "  "+undo.String())
+		}
+	}
+	if len(e.Stuck) > 0 {
+		lines = append(lines, fmt.Sprintf("Could not roll back %d changes, fix these by hand:", len(e.Stuck)))
+		for _, stuck := range e.Stuck {
+			lines = append(lines, fmt.Sprintf("  %s: %s", stuck.Undo, stuck.Err))
+		}
+	}
+	if len(e.RolledBack) == 0 && len(e.Stuck) == 0 {
+		lines = append(lines, "Nothing was changed")
+	}
+	return strings.Join(lines, "\n")
+}
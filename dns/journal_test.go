@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	"github.com/golang/mock/gomock"
+	"strings"
+	"testing"
+)
+
+const TestNewSubdomain = "_spfXYZ.example.com"
+const TestNewSubSPFTXT = "v=spf1 ip4:192.0.2.0/24 ~all"
+const TestNewTopSPFTXT = "v=spf1 include:_spfXYZ.example.com ~all"
+
+// Replaces the test top record and subrecord with new ones
+func testReplacePlan() *Plan {
+	return &Plan{
+		Domain: TestDomain,
+		Changes: []Change{
+			{Action: ActionCreate, Name: TestNewSubdomain, After: TestNewSubSPFTXT, TTL: 300},
+			{Action: ActionUpdate, ID: TestTopID, Name: TestDomain, Before: TestTopSPFTXT, After: TestNewTopSPFTXT, TTL: 300, BeforeTTL: 3600},
+			{Action: ActionDelete, ID: TestSubID, Name: TestSubdomain, Before: TestSubSPFTXT, BeforeTTL: 1800},
+		},
+	}
+}
+
+func TestUpdateDNS_Rollback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	failure := errors.New("rate limited")
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("New1", nil),
+		mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestNewTopSPFTXT, 300).Return(TestTopID, nil),
+		mockDNSAPI.EXPECT().DeleteTXTRecord("Top5678").Return(failure),
+		// Undone last to first, with the TTL the top record had
+		mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestTopSPFTXT, 3600).Return(TestTopID, nil),
+		mockDNSAPI.EXPECT().DeleteTXTRecord("New1").Return(nil),
+	)
+
+	// An extra top record, which is deleted right away unlike the old
+	// subrecord
+	plan := testReplacePlan()
+	plan.Changes = append(plan.Changes, Change{Action: ActionDelete, ID: "Top5678", Name: TestDomain, Before: "v=spf1 -all"})
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	err := u.updateDNS(context.Background(), plan, false)
+	rollback, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("Should roll back, instead got %v", err)
+	}
+	if rollback.Err != failure || rollback.Failed.ID != "Top5678" {
+		t.Errorf("Should report the failed delete, instead got %v", rollback)
+	}
+	if len(u.Pending.Deletions) != 0 {
+		t.Errorf("Should not queue the old subrecord when rolling back, instead got %v", u.Pending.Deletions)
+	}
+	if len(rollback.RolledBack) != 2 || len(rollback.Stuck) != 0 {
+		t.Fatalf("Should roll back two changes, instead got %v", rollback)
+	}
+	restore, remove := rollback.RolledBack[0], rollback.RolledBack[1]
+	if restore.Action != ActionUpdate || restore.After != TestTopSPFTXT || restore.Before != TestNewTopSPFTXT {
+		t.Errorf("Should restore the previous top record, instead got %v", restore)
+	}
+	if remove.Action != ActionDelete || remove.ID != "New1" {
+		t.Errorf("Should delete the new subrecord, instead got %v", remove)
+	}
+	if !strings.Contains(err.Error(), "Rolled back 2 changes") {
+		t.Errorf("Should report what was rolled back, instead got %s", err)
+	}
+}
+
+func TestJournal_RollbackDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().DeleteTXTRecord(TestSubID).Return(nil),
+		// Recreated with the TTL it had
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestSubdomain, TestSubSPFTXT, 1800).Return("New1", nil),
+	)
+
+	j := &journal{api: mockDNSAPI}
+	if err := j.apply(testReplacePlan().Changes[2]); err != nil {
+		t.Fatal(err)
+	}
+	rollback := j.rollback(Change{}, errors.New("interrupted"))
+	if len(rollback.RolledBack) != 1 || rollback.RolledBack[0].TTL != 1800 {
+		t.Errorf("Should recreate the deleted subrecord, instead got %v", rollback)
+	}
+}
+
+func TestUpdateDNS_RollbackFails(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("New1", nil),
+		mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestNewTopSPFTXT, 300).Return("", errors.New("timeout")),
+		mockDNSAPI.EXPECT().DeleteTXTRecord("New1").Return(errors.New("timeout")),
+	)
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	err := u.updateDNS(context.Background(), testReplacePlan(), false)
+	rollback, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("Should roll back, instead got %v", err)
+	}
+	if len(rollback.RolledBack) != 0 || len(rollback.Stuck) != 1 || rollback.Stuck[0].Undo.ID != "New1" {
+		t.Errorf("Should report the subrecord that could not be deleted, instead got %v", rollback)
+	}
+	if !strings.Contains(err.Error(), "fix these by hand") {
+		t.Errorf("Should report what is left, instead got %s", err)
+	}
+}
+
+func TestUpdateDNS_FirstChangeFails(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("", errors.New("forbidden"))
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	err := u.updateDNS(context.Background(), testReplacePlan(), false)
+	if err == nil || !strings.Contains(err.Error(), "Nothing was changed") {
+		t.Errorf("Should report that nothing was changed, instead got %v", err)
+	}
+}
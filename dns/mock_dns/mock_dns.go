@@ -50,26 +50,26 @@ func (_mr *_MockDNSAPIRecorder) GetTXTRecordContent(arg0 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTXTRecordContent", arg0)
 }
 
-func (_m *MockDNSAPI) WriteTXTRecord(_param0 string, _param1 string) (string, error) {
-	ret := _m.ctrl.Call(_m, "WriteTXTRecord", _param0, _param1)
+func (_m *MockDNSAPI) WriteTXTRecord(_param0 string, _param1 string, _param2 int) (string, error) {
+	ret := _m.ctrl.Call(_m, "WriteTXTRecord", _param0, _param1, _param2)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockDNSAPIRecorder) WriteTXTRecord(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteTXTRecord", arg0, arg1)
+func (_mr *_MockDNSAPIRecorder) WriteTXTRecord(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteTXTRecord", arg0, arg1, arg2)
 }
 
-func (_m *MockDNSAPI) UpdateTXTRecord(_param0 string, _param1 string, _param2 string) (string, error) {
-	ret := _m.ctrl.Call(_m, "UpdateTXTRecord", _param0, _param1, _param2)
+func (_m *MockDNSAPI) UpdateTXTRecord(_param0 string, _param1 string, _param2 string, _param3 int) (string, error) {
+	ret := _m.ctrl.Call(_m, "UpdateTXTRecord", _param0, _param1, _param2, _param3)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockDNSAPIRecorder) UpdateTXTRecord(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateTXTRecord", arg0, arg1, arg2)
+func (_mr *_MockDNSAPIRecorder) UpdateTXTRecord(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateTXTRecord", arg0, arg1, arg2, arg3)
 }
 
 func (_m *MockDNSAPI) DeleteTXTRecord(_param0 string) error {
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	spf "github.com/envoy/auto-spf-flattener/spf"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// An old subrecord to delete once no resolver can still have a top record
+// that includes it cached
+type PendingDeletion struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Content   string    `json:"content"`
+	NotBefore time.Time `json:"not_before"`
+}
+
+func (d PendingDeletion) String() string {
+	return fmt.Sprintf("%s (%s) after %s", d.Name, d.ID, d.NotBefore.Format(time.RFC3339))
+}
+
+// Subrecords waiting to be deleted, kept in a file so later runs delete
+// them when their time comes
+type PendingDeletions struct {
+	// Empty to only keep them in memory
+	Path      string
+	Deletions []PendingDeletion
+	// The clock, replaced in tests
+	now func() time.Time
+}
+
+// Reads the deletions saved at path. A missing file is an empty queue.
+func LoadPendingDeletions(path string) (*PendingDeletions, error) {
+	pending := &PendingDeletions{Path: path, Deletions: []PendingDeletion{}}
+	if path == "" {
+		return pending, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pending.Deletions); err != nil {
+		return nil, fmt.Errorf("Cannot read pending deletions %s: %s", path, err)
+	}
+	return pending, nil
+}
+
+func (p *PendingDeletions) Save() error {
+	if p.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.Deletions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.Path, data, 0600)
+}
+
+func (p *PendingDeletions) clock() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+// Deletes the queued subrecords whose time has come. Ones that are gone
+// already are forgotten, and so are ones the top record includes again,
+// if they are the only SPF record at their name.
+func (u *DnsUpdater) deletePending(dryRun bool) error {
+	if u.Pending == nil || len(u.Pending.Deletions) == 0 {
+		return nil
+	}
+	included, err := u.includedNames()
+	if err != nil {
+		return err
+	}
+	now := u.Pending.clock()
+	printer := &DNSPrinter{}
+	remaining := []PendingDeletion{}
+	for _, deletion := range u.Pending.Deletions {
+		if deletion.NotBefore.After(now) {
+			remaining = append(remaining, deletion)
+			continue
+		}
+		ids, err := u.filterTXTRecords(deletion.Name, "v=spf1")
+		if err != nil {
+			return err
+		}
+		if !contains(ids, deletion.ID) {
+			continue
+		}
+		if included[deletion.Name] && len(ids) == 1 {
+			fmt.Printf("Keeping %s (%s), the top record includes it again\n", deletion.Name, deletion.ID)
+			continue
+		}
+		printer.DeleteTXTRecord(deletion.ID)
+		if dryRun {
+			remaining = append(remaining, deletion)
+			continue
+		}
+		if err := u.Api.DeleteTXTRecord(deletion.ID); err != nil {
+			fmt.Printf("Warning: cannot delete %s (%s), trying again next time: %s\n", deletion.Name, deletion.ID, err)
+			remaining = append(remaining, deletion)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	u.Pending.Deletions = remaining
+	return u.Pending.Save()
+}
+
+// The names the SPF records at the top domain include
+func (u *DnsUpdater) includedNames() (map[string]bool, error) {
+	included := map[string]bool{}
+	ids, err := u.filterTXTRecords(u.topDomain, "v=spf1")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		content, err := u.getTXTRecordContent(id, u.topDomain)
+		if err != nil {
+			return nil, err
+		}
+		topSPF := spf.NewSPF()
+		if topSPF.Parse(content) == nil {
+			for _, include := range topSPF.Values(spf.KindInclude) {
+				included[include] = true
+			}
+		}
+	}
+	return included, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
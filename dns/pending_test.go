@@ -0,0 +1,64 @@
+package dns
+
+import (
+	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	"github.com/golang/mock/gomock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeletePending(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	pending := &PendingDeletions{
+		Path: filepath.Join(dir, "pending.json"),
+		Deletions: []PendingDeletion{
+			{ID: "Later", Name: "_spfAAA.example.com", NotBefore: now.Add(time.Minute)},
+			{ID: "Due", Name: "_spfBBB.example.com", NotBefore: now},
+			{ID: "Gone", Name: "_spfCCC.example.com", NotBefore: now},
+			{ID: TestSubID, Name: TestSubdomain, NotBefore: now},
+		},
+		now: func() time.Time { return now },
+	}
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent(TestTopID).Return(TestTopSPFTXT, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords("_spfBBB.example.com", "v=spf1").Return([]string{"Due"}, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords("_spfCCC.example.com", "v=spf1").Return([]string{}, nil)
+	// The top record includes it again
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestSubdomain, "v=spf1").Return([]string{TestSubID}, nil)
+	mockDNSAPI.EXPECT().DeleteTXTRecord("Due").Return(nil)
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	u.Pending = pending
+	if err := u.deletePending(false); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := LoadPendingDeletions(pending.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Deletions) != 1 || saved.Deletions[0].ID != "Later" {
+		t.Errorf("Should only keep the deletion that isn't due, instead got %v", saved.Deletions)
+	}
+}
+
+func TestLoadPendingDeletions_Missing(t *testing.T) {
+	pending, err := LoadPendingDeletions(filepath.Join(os.TempDir(), "does-not-exist", "pending.json"))
+	if err != nil || len(pending.Deletions) != 0 {
+		t.Errorf("Should start with an empty queue: %v %v", pending, err)
+	}
+}
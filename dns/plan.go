@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	spf "github.com/envoy/auto-spf-flattener/spf"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// One record to create, update or delete
+type Change struct {
+	Action string `json:"action"`
+	// Provider ID of the record to update or delete
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	// Content now, empty for creates
+	Before string `json:"before,omitempty"`
+	// Content afterwards, empty for deletes
+	After string `json:"after,omitempty"`
+	// In seconds, 0 for the provider's default
+	TTL int `json:"ttl,omitempty"`
+	// TTL of the record now, which rolling back an update or delete restores
+	BeforeTTL int `json:"before_ttl,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return fmt.Sprintf("create %s: `%s`", c.Name, c.After)
+	case ActionUpdate:
+		return fmt.Sprintf("update %s (%s): `%s` -> `%s`", c.Name, c.ID, c.Before, c.After)
+	}
+	return fmt.Sprintf("delete %s (%s): `%s`", c.Name, c.ID, c.Before)
+}
+
+// An SPF record in the zone when a plan was made
+type ObservedRecord struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	// In seconds, 0 when the API can't tell
+	TTL int `json:"ttl,omitempty"`
+}
+
+// The changes that bring the zone to the flattened records, in the order
+// they are applied, with the records they were worked out from. Plans are
+// saved as JSON for review and applied later unchanged.
+type Plan struct {
+	Domain  string    `json:"domain"`
+	Created time.Time `json:"created"`
+	// The SPF records at the top domain and the names they include
+	Observed []ObservedRecord `json:"observed"`
+	Changes  []Change         `json:"changes"`
+}
+
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, fmt.Errorf("Cannot read plan: %s", err)
+	}
+	for i, change := range plan.Changes {
+		switch change.Action {
+		case ActionCreate, ActionUpdate, ActionDelete:
+		default:
+			return nil, fmt.Errorf("Cannot read plan: change %d has unknown action %q", i+1, change.Action)
+		}
+	}
+	return plan, nil
+}
+
+func (p *Plan) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (p *Plan) String() string {
+	if len(p.Changes) == 0 {
+		return "No changes to " + p.Domain
+	}
+	lines := []string{fmt.Sprintf("%d changes to %s:", len(p.Changes), p.Domain)}
+	for _, change := range p.Changes {
+		lines = append(lines, "  "+change.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The zone changed after the plan was made, so applying it could undo
+// someone else's changes
+type DriftError struct {
+	Domain string
+	// Observed records that changed or went away, and ones that are new
+	Missing []ObservedRecord
+	Added   []ObservedRecord
+}
+
+func (e *DriftError) Error() string {
+	parts := []string{}
+	for _, record := range e.Missing {
+		parts = append(parts, fmt.Sprintf("%s (%s) was `%s`", record.Name, record.ID, record.Content))
+	}
+	for _, record := range e.Added {
+		parts = append(parts, fmt.Sprintf("%s (%s) is now `%s`", record.Name, record.ID, record.Content))
+	}
+	return fmt.Sprintf("SPF records of %s changed since the plan was made: %s", e.Domain, strings.Join(parts, "; "))
+}
+
+// Compares the records observed for two plans, nil if they are the same
+func drift(domain string, before, after []ObservedRecord) error {
+	key := func(r ObservedRecord) string {
+		return r.ID + "\x00" + r.Name + "\x00" + r.Content
+	}
+	seen := map[string]bool{}
+	for _, record := range after {
+		seen[key(record)] = true
+	}
+	drifted := &DriftError{Domain: domain}
+	for _, record := range before {
+		if !seen[key(record)] {
+			drifted.Missing = append(drifted.Missing, record)
+		}
+		delete(seen, key(record))
+	}
+	for _, record := range after {
+		if seen[key(record)] {
+			drifted.Added = append(drifted.Added, record)
+		}
+	}
+	if len(drifted.Missing) == 0 && len(drifted.Added) == 0 {
+		return nil
+	}
+	return drifted
+}
+
+// Reads every SPF record that changes could touch before anything is
+// written, failing with an *IncompleteReadError when any of them can't be
+// read
+func (u *DnsUpdater) precheck() ([]ObservedRecord, error) {
+	observed, err := u.observe()
+	if err != nil {
+		return nil, &IncompleteReadError{Domain: u.topDomain, Err: err}
+	}
+	return observed, nil
+}
+
+// Reads the SPF records at the top domain and every name they include,
+// sorted by name and ID
+func (u *DnsUpdater) observe() ([]ObservedRecord, error) {
+	observed := []ObservedRecord{}
+	seen := map[string]bool{}
+	var read func(name string, follow bool) error
+	read = func(name string, follow bool) error {
+		ids, err := u.filterTXTRecords(name, "v=spf1")
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			content, err := u.getTXTRecordContent(id, name)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(content, "v=spf1") {
+				// Listed as SPF a moment ago
+				return fmt.Errorf("Record %s at %s changed while reading it, to `%s`", id, name, content)
+			}
+			ttl, err := u.getTXTRecordTTL(id, name)
+			if err != nil {
+				return err
+			}
+			observed = append(observed, ObservedRecord{ID: id, Name: name, Content: content, TTL: ttl})
+			if !follow {
+				continue
+			}
+			rec := spf.NewSPF()
+			if rec.Parse(content) != nil {
+				continue
+			}
+			for _, include := range rec.Values(spf.KindInclude) {
+				if err := read(include, false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := read(u.topDomain, true); err != nil {
+		return nil, err
+	}
+	sort.Slice(observed, func(i, j int) bool {
+		if observed[i].Name != observed[j].Name {
+			return observed[i].Name < observed[j].Name
+		}
+		return observed[i].ID < observed[j].ID
+	})
+	return observed, nil
+}
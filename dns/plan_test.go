@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	spf "github.com/envoy/auto-spf-flattener/spf"
+	"github.com/golang/mock/gomock"
+	"strings"
+	"testing"
+)
+
+const TestIdealTXT = "v=spf1 ip4:192.0.2.0/24 -all"
+
+// The zone has the test top record including the test subrecord, and may
+// be read any number of times
+func expectZone(api *mock_dns.MockDNSAPI, topContent string) {
+	api.EXPECT().FilterTXTRecords(TestDomain, "").Return([]string{TestTopID}, nil).AnyTimes()
+	api.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil).AnyTimes()
+	api.EXPECT().FilterTXTRecords(TestDomain, TestIdealTXT).Return([]string{}, nil).AnyTimes()
+	api.EXPECT().GetTXTRecordContent(TestTopID).Return(topContent, nil).AnyTimes()
+	api.EXPECT().FilterTXTRecords(TestSubdomain, "v=spf1").Return([]string{TestSubID}, nil).AnyTimes()
+	api.EXPECT().GetTXTRecordContent(TestSubID).Return(TestSubSPFTXT, nil).AnyTimes()
+}
+
+func testPlan(t *testing.T, u *DnsUpdater) *Plan {
+	ideal := spf.NewSPF()
+	if err := ideal.Parse(TestIdealTXT); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := u.Plan(context.Background(), ideal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestPlan(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	expectZone(mockDNSAPI, TestTopSPFTXT)
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	plan := testPlan(t, u)
+
+	expected := []ObservedRecord{
+		{TestSubID, TestSubdomain, TestSubSPFTXT, 0},
+		{TestTopID, TestDomain, TestTopSPFTXT, 0},
+	}
+	if fmt.Sprintf("%v", plan.Observed) != fmt.Sprintf("%v", expected) {
+		t.Errorf("Should observe the top record and its subrecord, instead got %v", plan.Observed)
+	}
+	if len(plan.Changes) != 2 {
+		t.Fatalf("Should plan two changes, instead got %v", plan.Changes)
+	}
+	update, del := plan.Changes[0], plan.Changes[1]
+	if update.Action != ActionUpdate || update.ID != TestTopID || update.Before != TestTopSPFTXT || update.After != TestIdealTXT {
+		t.Errorf("Should update the top record to the ideal one, instead got %v", update)
+	}
+	if del.Action != ActionDelete || del.ID != TestSubID || del.Name != TestSubdomain || del.Before != TestSubSPFTXT {
+		t.Errorf("Should delete the old subrecord, instead got %v", del)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := plan.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPlan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Domain != plan.Domain || !read.Created.Equal(plan.Created) ||
+		fmt.Sprintf("%v", read.Observed) != fmt.Sprintf("%v", plan.Observed) ||
+		fmt.Sprintf("%v", read.Changes) != fmt.Sprintf("%v", plan.Changes) {
+		t.Errorf("Should read the plan back unchanged, instead got %v", read)
+	}
+}
+
+// A DNS API that knows the TTLs of its records
+type ttlDNSAPI struct {
+	*mock_dns.MockDNSAPI
+	ttls map[string]int
+}
+
+func (a *ttlDNSAPI) GetTXTRecordTTL(id string) (int, error) {
+	return a.ttls[id], nil
+}
+
+func TestPlan_BeforeTTLs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	expectZone(mockDNSAPI, TestTopSPFTXT)
+	api := &ttlDNSAPI{mockDNSAPI, map[string]int{TestTopID: 3600, TestSubID: 1800}}
+	plan := testPlan(t, NewDNSUpdater(api, TestDomain, "_spf"))
+
+	if len(plan.Observed) != 2 || plan.Observed[0].TTL != 1800 || plan.Observed[1].TTL != 3600 {
+		t.Errorf("Should observe the TTLs, instead got %v", plan.Observed)
+	}
+	if len(plan.Changes) != 2 {
+		t.Fatalf("Should plan two changes, instead got %v", plan.Changes)
+	}
+	if update := plan.Changes[0]; update.BeforeTTL != 3600 {
+		t.Errorf("Should keep the TTL of the top record to restore, instead got %d", update.BeforeTTL)
+	}
+	if del := plan.Changes[1]; del.BeforeTTL != 1800 {
+		t.Errorf("Should keep the TTL of the old subrecord to restore, instead got %d", del.BeforeTTL)
+	}
+}
+
+func TestPlan_NoChange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "").Return([]string{TestTopID}, nil).AnyTimes()
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil).AnyTimes()
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, TestIdealTXT).Return([]string{TestTopID}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent(TestTopID).Return(TestIdealTXT, nil).AnyTimes()
+
+	plan := testPlan(t, NewDNSUpdater(mockDNSAPI, TestDomain, "_spf"))
+	if len(plan.Changes) != 0 {
+		t.Errorf("Should plan no changes, instead got %v", plan.Changes)
+	}
+}
+
+func TestPlan_WithinLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Flattening fails on the macro, but nothing needs flattening
+	idealTXT := "v=spf1 include:_spf.vendor.com -all"
+	ideal := spf.NewSPF()
+	if err := ideal.Parse(idealTXT); err != nil {
+		t.Fatal(err)
+	}
+	fixture := spf.NewFixture()
+	fixture.Records["_spf.vendor.com"] = &spf.FixtureRecords{TXT: []string{"v=spf1 a:%{d}.mail.vendor.com -all"}, TTLs: map[string]uint32{"TXT": 3600}}
+	ideal.Querent = spf.NewFixtureQuerent(fixture)
+	if _, err := ideal.Flatten(context.Background()); err == nil {
+		t.Fatal("Flattening the vendor record should fail")
+	}
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "").Return([]string{TestTopID}, nil).AnyTimes()
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil).AnyTimes()
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, idealTXT).Return([]string{}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent(TestTopID).Return("v=spf1 -all", nil).AnyTimes()
+	plan, err := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf").Plan(context.Background(), ideal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Action != ActionUpdate || plan.Changes[0].After != idealTXT || plan.Changes[0].TTL != 3600 {
+		t.Errorf("Should publish the ideal record as it is, with the TTL of what it includes, instead got %v", plan.Changes)
+	}
+}
+
+func TestPlan_IncompleteRead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{TestTopID}, nil)
+	mockDNSAPI.EXPECT().GetTXTRecordContent(TestTopID).Return(TestTopSPFTXT, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestSubdomain, "v=spf1").Return(nil, errors.New("timeout"))
+
+	ideal := spf.NewSPF()
+	ideal.Parse(TestIdealTXT)
+	err := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf").Update(context.Background(), ideal, false)
+	incomplete, ok := err.(*IncompleteReadError)
+	if !ok {
+		t.Fatalf("Should refuse to change a zone it cannot read, instead got %v", err)
+	}
+	if !strings.Contains(incomplete.Error(), TestSubdomain) {
+		t.Errorf("Should say which name could not be read, instead got %s", incomplete)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	expectZone(mockDNSAPI, TestTopSPFTXT)
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	plan := testPlan(t, u)
+
+	mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestIdealTXT, gomock.Any()).Return(TestTopID, nil)
+	if err := u.Apply(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	// The old subrecord is queued, not deleted
+	if len(u.Pending.Deletions) != 1 || u.Pending.Deletions[0].ID != TestSubID {
+		t.Errorf("Should queue the old subrecord for deletion, instead got %v", u.Pending.Deletions)
+	}
+}
+
+func TestApply_Drift(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	planned := mock_dns.NewMockDNSAPI(ctrl)
+	expectZone(planned, TestTopSPFTXT)
+	plan := testPlan(t, NewDNSUpdater(planned, TestDomain, "_spf"))
+
+	// Someone changed the top record since, nothing may be written
+	changedTXT := "v=spf1 include:_spfABC.example.com include:other.example.net ~all"
+	changed := mock_dns.NewMockDNSAPI(ctrl)
+	expectZone(changed, changedTXT)
+	changed.EXPECT().FilterTXTRecords("other.example.net", "v=spf1").Return([]string{}, nil)
+	err := NewDNSUpdater(changed, TestDomain, "_spf").Apply(context.Background(), plan)
+	drifted, ok := err.(*DriftError)
+	if !ok {
+		t.Fatalf("Should refuse a plan for a changed zone, instead got %v", err)
+	}
+	if len(drifted.Missing) != 1 || drifted.Missing[0].Content != TestTopSPFTXT ||
+		len(drifted.Added) != 1 || drifted.Added[0].Content != changedTXT {
+		t.Errorf("Should report the changed top record, instead got %v", drifted)
+	}
+
+	if err := NewDNSUpdater(changed, "example.net", "_spf").Apply(context.Background(), plan); err == nil {
+		t.Error("Should refuse a plan for another domain")
+	}
+}
+
+func TestReadPlan_UnknownAction(t *testing.T) {
+	_, err := ReadPlan(strings.NewReader(`{"domain": "example.com", "changes": [{"action": "rename", "name": "example.com"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "rename") {
+		t.Errorf("Should refuse an unknown action, instead got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Asks each authoritative nameserver of a name on its own,
+// *spf.WireQuerent is one
+type AuthorityQuerent interface {
+	QueryAuthoritiesTTL(ctx context.Context, name string) (map[string][]string, time.Duration, error)
+}
+
+// Waits until every authoritative nameserver has the records created, so
+// no resolver can get the new top record and then miss its includes
+func (u *DnsUpdater) waitForPropagation(ctx context.Context, created []Change) error {
+	for {
+		missing, err := u.unpropagated(ctx, created)
+		if err == nil && missing == "" {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s is still missing", missing)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Gave up waiting for new records to reach every authoritative nameserver: %s", err)
+		case <-time.After(u.PropagationInterval):
+		}
+	}
+}
+
+// The first created record some authoritative nameserver doesn't have yet,
+// empty when they all have all of them
+func (u *DnsUpdater) unpropagated(ctx context.Context, created []Change) (string, error) {
+	for _, change := range created {
+		byServer, _, err := u.Authorities.QueryAuthoritiesTTL(ctx, u.qualify(change.Name))
+		if err != nil {
+			return "", err
+		}
+		for server, txts := range byServer {
+			if !contains(txts, change.After) {
+				return fmt.Sprintf("%s on %s", change.Name, server), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Subrecord names are relative to the top domain, nameservers need the
+// full name
+func (u *DnsUpdater) qualify(name string) string {
+	if name == u.topDomain || strings.HasSuffix(name, "."+u.topDomain) {
+		return name
+	}
+	return name + "." + u.topDomain
+}
+
+// How long old subrecords must stay after the top record switched: as
+// long as resolvers may cache the old top record, and at least
+// DeleteDelay. Without its TTL, as long as top records are published for.
+func (u *DnsUpdater) deleteDelay(ctx context.Context) time.Duration {
+	delay := u.MaxTTL
+	if u.Authorities != nil {
+		if _, ttl, err := u.Authorities.QueryAuthoritiesTTL(ctx, u.topDomain); err == nil && ttl > 0 {
+			delay = ttl
+		}
+	}
+	if delay < u.DeleteDelay {
+		return u.DeleteDelay
+	}
+	return delay
+}
@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	mock_dns "github.com/envoy/auto-spf-flattener/dns/mock_dns"
+	spf "github.com/envoy/auto-spf-flattener/spf"
+	"github.com/golang/mock/gomock"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Two authoritative nameservers, the second one gets new records after a
+// number of queries
+type testAuthorities struct {
+	mu      sync.Mutex
+	records map[string][]string
+	ttl     time.Duration
+	// Queries until the second server has the records too, -1 for never
+	lag     int
+	queries int
+}
+
+func (a *testAuthorities) QueryAuthoritiesTTL(ctx context.Context, name string) (map[string][]string, time.Duration, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.queries++
+	second := a.records[name]
+	if a.lag < 0 || a.queries <= a.lag {
+		second = []string{}
+	}
+	return map[string][]string{"192.0.2.1:53": a.records[name], "192.0.2.2:53": second}, a.ttl, nil
+}
+
+func (a *testAuthorities) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queries
+}
+
+func TestUpdateDNS_Staged(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	authorities := &testAuthorities{
+		records: map[string][]string{TestNewSubdomain: {TestNewSubSPFTXT}},
+		ttl:     time.Hour,
+		lag:     2,
+	}
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("New1", nil),
+		mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestNewTopSPFTXT, 300).Do(func(id, name, txt string, ttl int) {
+			if authorities.count() < 3 {
+				t.Error("Should switch the top record only once both nameservers have the subrecord")
+			}
+		}).Return(TestTopID, nil),
+	)
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	u.Authorities = authorities
+	u.PropagationInterval = time.Millisecond
+	u.Pending = &PendingDeletions{now: func() time.Time { return now }}
+	if err := u.updateDNS(context.Background(), testReplacePlan(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old subrecord stays for as long as the old top record is cached
+	pending := u.Pending.Deletions
+	if len(pending) != 1 || pending[0].ID != TestSubID || !pending[0].NotBefore.Equal(now.Add(time.Hour)) {
+		t.Errorf("Should queue the old subrecord for deletion in an hour, instead got %v", pending)
+	}
+}
+
+func TestUpdateDNS_NoQueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Any delete would fail the test
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("New1", nil),
+		mockDNSAPI.EXPECT().UpdateTXTRecord(TestTopID, TestDomain, TestNewTopSPFTXT, 300).Return(TestTopID, nil),
+	)
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	start := time.Now()
+	if err := u.updateDNS(context.Background(), testReplacePlan(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the top record's TTL, kept for as long as top records are
+	// published for
+	if u.Pending == nil || len(u.Pending.Deletions) != 1 || u.Pending.Deletions[0].ID != TestSubID ||
+		u.Pending.Deletions[0].NotBefore.Before(start.Add(u.MaxTTL)) {
+		t.Errorf("Should queue the old subrecord in memory for a day, instead got %v", u.Pending)
+	}
+}
+
+func TestUpdate_WaitsForPlannedSubrecords(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Too large for one record, so it is split into subrecords
+	terms := []string{"v=spf1"}
+	for i := 1; i <= 40; i++ {
+		terms = append(terms, fmt.Sprintf("ip4:192.0.2.%d", i))
+	}
+	ideal := spf.NewSPF()
+	if err := ideal.Parse(strings.Join(append(terms, "-all"), " ")); err != nil {
+		t.Fatal(err)
+	}
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "").Return([]string{}, nil)
+	mockDNSAPI.EXPECT().FilterTXTRecords(TestDomain, "v=spf1").Return([]string{}, nil).AnyTimes()
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	plan, err := u.Plan(context.Background(), ideal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The nameservers know the subrecords by their full names
+	authorities := &testAuthorities{records: map[string][]string{}}
+	subrecords := 0
+	for _, change := range plan.Changes {
+		if change.Action == ActionCreate && change.Name != TestDomain {
+			authorities.records[change.Name+"."+TestDomain] = []string{change.After}
+			mockDNSAPI.EXPECT().WriteTXTRecord(change.Name, change.After, gomock.Any()).Return("New", nil)
+			subrecords++
+		}
+	}
+	if subrecords == 0 {
+		t.Fatalf("Should plan subrecords, instead got %v", plan.Changes)
+	}
+	mockDNSAPI.EXPECT().WriteTXTRecord(TestDomain, gomock.Any(), gomock.Any()).Return("Top", nil)
+
+	u.Authorities = authorities
+	u.PropagationInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := u.updateDNS(ctx, plan, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateDNS_NotPropagated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDNSAPI := mock_dns.NewMockDNSAPI(ctrl)
+	gomock.InOrder(
+		mockDNSAPI.EXPECT().WriteTXTRecord(TestNewSubdomain, TestNewSubSPFTXT, 300).Return("New1", nil),
+		mockDNSAPI.EXPECT().DeleteTXTRecord("New1").Return(nil),
+	)
+
+	u := NewDNSUpdater(mockDNSAPI, TestDomain, "_spf")
+	u.Authorities = &testAuthorities{records: map[string][]string{TestNewSubdomain: {TestNewSubSPFTXT}}, lag: -1}
+	u.PropagationInterval = time.Millisecond
+	u.Pending = &PendingDeletions{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := u.updateDNS(ctx, testReplacePlan(), false)
+	rollback, ok := err.(*RollbackError)
+	if !ok || rollback.Failed.Name != TestDomain || len(rollback.RolledBack) != 1 {
+		t.Errorf("Should give up and delete the new subrecord, instead got %v", err)
+	}
+	if len(u.Pending.Deletions) != 0 {
+		t.Errorf("Should keep the old subrecord, instead queued %v", u.Pending.Deletions)
+	}
+}
+
+func TestDeleteDelay(t *testing.T) {
+	u := NewDNSUpdater(nil, TestDomain, "_spf")
+	if delay := u.deleteDelay(context.Background()); delay != u.MaxTTL {
+		t.Errorf("Should wait as long as top records are published for without their TTL, instead got %s", delay)
+	}
+	u.Authorities = &testAuthorities{ttl: time.Minute}
+	if delay := u.deleteDelay(context.Background()); delay != u.DeleteDelay {
+		t.Errorf("Should wait at least %s, instead got %s", u.DeleteDelay, delay)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	dns "github.com/envoy/auto-spf-flattener/dns"
 	cf "github.com/envoy/auto-spf-flattener/dns/cloudflare"
@@ -9,27 +10,131 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 )
 
+var command string
 var topDomain string
 var spfSubdomainPrefix string
 var spfFile string
 var dryRun bool
+var planFile string
+var waitForPropagation bool
+var pendingFile string
+var deleteDelay time.Duration
+var gc bool
+var gcGrace time.Duration
+var gcPrefixes []string
+var onParseError string
+var onMultipleRecords string
+var verify bool
+var responseSize int
+var maxDepth int
+var maxQueries int
+var concurrency int
+var timeout time.Duration
+var queryTimeout time.Duration
+var retries int
+var resolvers []string
+var authoritative bool
+var quorum int
+var cacheFile string
+var replayFile string
+var recordFile string
+var onNoConsensus string
+var minTTL time.Duration
+var maxTTL time.Duration
 
 func init() {
 	flag.StringVarP(&spfFile, "spf-file", "f", "", "File that contains a valid spf format TXT record (required)")
 	flag.StringVarP(&spfSubdomainPrefix, "spf-prefix", "p", "_spf", "Prefix for subdomains when multiple are needed.")
 	flag.BoolVarP(&dryRun, "dry-run", "d", false, "Connect to DNS, but don't make any changes")
+	flag.StringVar(&planFile, "plan", "", "File the plan command writes its JSON plan of changes to, and apply reads it from (required for both)")
+	flag.BoolVar(&waitForPropagation, "wait-for-propagation", false, "Switch the top record only once every authoritative nameserver has the new subrecords")
+	flag.StringVar(&pendingFile, "pending-deletions", "spf-pending-deletions.json", "File to queue old subrecords in until resolvers can't have the old top record cached, later runs delete them. Empty to queue them in memory only, for gc to delete.")
+	flag.DurationVar(&deleteDelay, "delete-delay", 5*time.Minute, "Shortest time to keep queued old subrecords for")
+	flag.BoolVar(&gc, "gc", false, "After updating, delete subrecords under the prefix that the top record doesn't include, like the gc command")
+	flag.StringSliceVar(&gcPrefixes, "gc-prefix", nil, "A prefix used before, whose subrecords gc deletes as well when the top record doesn't include them. Can be given more than once.")
+	flag.DurationVar(&gcGrace, "gc-grace", 24*time.Hour, "Only delete unincluded subrecords that haven't changed for this long")
+	flag.BoolVar(&verify, "verify", false, "Refuse to change DNS when the published records would authorize other addresses than the spf-file")
+	flag.IntVar(&responseSize, "response-size", spf.UDP_RESPONSE_SIZE, "Largest DNS response a record may need, over 512 only if all receivers use EDNS0")
+	flag.IntVar(&maxDepth, "max-depth", spf.DEFAULT_MAX_DEPTH, "How deep to follow includes and redirects, 0 for no limit")
+	flag.IntVar(&maxQueries, "max-queries", spf.DEFAULT_MAX_QUERIES, "Most DNS queries to make while flattening, 0 for no limit")
+	flag.IntVar(&concurrency, "concurrency", 8, "How many DNS queries to make at once while flattening")
+	flag.DurationVar(&timeout, "timeout", 2*time.Minute, "How long all DNS queries may take together, waiting for propagation included")
+	flag.DurationVar(&queryTimeout, "query-timeout", 2*time.Second, "How long a single DNS query may take")
+	flag.IntVar(&retries, "retries", 2, "How often to retry DNS queries that time out or fail temporarily")
+	flag.StringSliceVar(&resolvers, "resolver", nil, "host:port of a DNS resolver to query, tried in the order given, the nameservers in /etc/resolv.conf by default")
+	flag.BoolVar(&authoritative, "authoritative", false, "Query the authoritative nameservers of every name, so stale cached records are never flattened")
+	flag.DurationVar(&minTTL, "min-ttl", 5*time.Minute, "Shortest TTL to publish flattened records with, 0 for no limit")
+	flag.DurationVar(&maxTTL, "max-ttl", 24*time.Hour, "Longest TTL to publish flattened records with, 0 for no limit")
+	flag.StringVar(&cacheFile, "cache", "", "File to keep DNS answers in between runs, for as long as their TTLs allow")
+	flag.StringVar(&replayFile, "replay", "", "Answer DNS queries from a zone file, or JSON if it ends in .json, instead of asking resolvers")
+	flag.StringVar(&recordFile, "record", "", "Save every DNS answer flattening used to a zone file, or JSON if it ends in .json, to replay later")
+	flag.IntVar(&quorum, "quorum", 0, "How many resolvers must give the same answer, 0 to only ask the first one that answers")
+	flag.StringVar(&onNoConsensus, "on-no-consensus", "fail", "What to do when fewer resolvers than the quorum agree: fail, or fallback to the first resolver")
+	flag.StringVar(&onParseError, "on-parse-error", "fail", "What to do with malformed upstream SPF records: fail or skip")
+	flag.StringVar(&onMultipleRecords, "on-multiple-records", "fail", "What to do when a name has more than one SPF record: fail, warn and flatten all of them, or pick the first in sorted order")
 	flag.Parse()
+	if len(resolvers) == 0 {
+		var err error
+		if resolvers, err = spf.SystemResolvers(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s, querying through the system resolver instead, which knows no TTLs\n", err)
+		}
+	}
 
-	if flag.NArg() != 1 || spfFile == "" {
-		fmt.Fprintf(os.Stderr, "Usage: %s -f spf-file [-p subdomain-prefix] domain\n\n", os.Args[0])
+	args := flag.Args()
+	if len(args) == 2 && (args[0] == "plan" || args[0] == "apply" || args[0] == "gc") {
+		command, args = args[0], args[1:]
+	}
+	if len(args) != 1 || (spfFile == "" && command != "apply" && command != "gc") ||
+		((command == "plan" || command == "apply") && planFile == "") || (onParseError != "fail" && onParseError != "skip") ||
+		(onMultipleRecords != "fail" && onMultipleRecords != "warn" && onMultipleRecords != "pick") ||
+		(onNoConsensus != "fail" && onNoConsensus != "fallback") || (quorum > 0 && quorum > len(resolvers)) ||
+		(waitForPropagation && len(resolvers) == 0) {
+		fmt.Fprintf(os.Stderr, "Usage: %s -f spf-file [-p subdomain-prefix] domain\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -f spf-file [-p subdomain-prefix] --plan plan-file plan domain\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s --plan plan-file apply domain\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-p subdomain-prefix] [--gc-prefix old-prefix] [--gc-grace duration] gc domain\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Use the SPF record you would have put in your DNS if you weren't worried about too many lookups or too large a response\n")
 		fmt.Fprintf(os.Stderr, "Environment variables CF_API_EMAIL and CF_API_KEY are required\n\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	topDomain = flag.Arg(0)
+	topDomain = args[0]
+}
+
+// Queries the resolvers, each on their own when a quorum of them has to
+// agree
+func newQuerent() spf.TXTQuerent {
+	retry := func(querent spf.TXTQuerent) *spf.RetryQuerent {
+		r := spf.NewRetryQuerent(querent)
+		r.Timeout = queryTimeout
+		r.Retries = retries
+		return r
+	}
+	if len(resolvers) == 0 {
+		// Fall back to the net package, which knows no TTLs
+		return retry(spf.SimpleTXTQuerent{})
+	}
+	if quorum == 0 {
+		wire := spf.NewWireQuerent(resolvers...)
+		wire.Authoritative = authoritative
+		return retry(wire)
+	}
+
+	consensus := spf.NewConsensusQuerent()
+	consensus.Quorum = quorum
+	for _, resolver := range resolvers {
+		wire := spf.NewWireQuerent(resolver)
+		wire.Authoritative = authoritative
+		consensus.Voters = append(consensus.Voters, spf.Voter{Name: resolver, Querent: retry(wire)})
+	}
+	if onNoConsensus == "fallback" {
+		// The resolver given first is trusted most
+		consensus.Fallback = consensus.Voters[0].Querent
+	}
+	return consensus
 }
 
 func main() {
@@ -38,6 +143,42 @@ func main() {
 	client := cf.NewCloudflareAPIClient(topDomain)
 
 	updater := dns.NewDNSUpdater(client, topDomain, spfSubdomainPrefix)
+	updater.Verify = verify
+	updater.ResponseSize = responseSize
+	updater.MinTTL = minTTL
+	updater.MaxTTL = maxTTL
+	updater.DeleteDelay = deleteDelay
+	updater.GC = gc
+	updater.GCGrace = gcGrace
+	updater.GCPrefixes = gcPrefixes
+	if waitForPropagation {
+		// Only finds the nameservers, they are asked directly
+		authorities := spf.NewRetryQuerent(spf.NewWireQuerent(resolvers...))
+		authorities.Timeout = queryTimeout
+		authorities.Retries = retries
+		updater.Authorities = authorities
+	}
+	pending, err := dns.LoadPendingDeletions(pendingFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	updater.Pending = pending
+
+	if command == "apply" {
+		if err := applyPlan(updater); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == "gc" {
+		if err := updater.CollectGarbage(dryRun); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	dat, err := ioutil.ReadFile(spfFile)
 	if err != nil {
@@ -46,10 +187,104 @@ func main() {
 	spfString := strings.TrimSpace(string(dat))
 
 	idealSPF := spf.NewSPF()
-	idealSPF.Parse(spfString)
+	if err := idealSPF.Parse(spfString); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cache := spf.NewCacheQuerent(newQuerent())
+	cache.Path = cacheFile
+	if err := cache.Load(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	var querent spf.TXTQuerent = cache
+	if replayFile != "" {
+		fixture, err := spf.LoadFixture(replayFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		querent = spf.NewFixtureQuerent(fixture)
+	}
+	var recorder *spf.FixtureQuerent
+	if recordFile != "" {
+		recorder = spf.NewRecordingQuerent(querent)
+		querent = recorder
+	}
+	idealSPF.Querent = querent
+	idealSPF.MaxDepth = maxDepth
+	idealSPF.MaxQueries = maxQueries
+	idealSPF.Concurrency = concurrency
+	if onParseError == "skip" {
+		idealSPF.ParseErrorPolicy = spf.ParseErrorSkip
+	}
+	switch onMultipleRecords {
+	case "warn":
+		idealSPF.MultipleRecordsPolicy = spf.MultipleRecordsWarn
+	case "pick":
+		idealSPF.MultipleRecordsPolicy = spf.MultipleRecordsPick
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if command == "plan" {
+		err = writePlan(ctx, updater, idealSPF)
+	} else {
+		err = updater.Update(ctx, idealSPF, dryRun)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Println("DNS " + cache.Stats().String())
+	if err := cache.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if recorder != nil {
+		if err := recorder.Fixture.Save(recordFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if err != nil {
+		// Only after saving what the answers were, to look into the failure
+		os.Exit(1)
+	}
+}
 
-	err = updater.Update(idealSPF, dryRun)
+// Works out the changes without making them and saves them to the plan
+// file for review
+func writePlan(ctx context.Context, updater *dns.DnsUpdater, idealSPF *spf.SPF) error {
+	plan, err := updater.Plan(ctx, idealSPF)
+	if err != nil {
+		return err
+	}
+	fmt.Println(plan)
+	file, err := os.Create(planFile)
 	if err != nil {
-		fmt.Println(err)
+		return err
+	}
+	if err := plan.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Makes the changes saved in the plan file, or none of them when the zone
+// changed since
+func applyPlan(updater *dns.DnsUpdater) error {
+	file, err := os.Open(planFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	plan, err := dns.ReadPlan(file)
+	if err != nil {
+		return err
+	}
+	fmt.Println(plan)
+	if dryRun {
+		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return updater.Apply(ctx, plan)
 }
@@ -0,0 +1,236 @@
+package spf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remembers answers for as long as their TTL allows, and names that don't
+// exist for NegativeTTL, so the same vendors aren't asked again every run.
+// Temporary failures are never cached.
+type CacheQuerent struct {
+	Querent TXTQuerent
+	// How long to keep answers whose TTL is unknown, 0 to not keep them
+	DefaultTTL time.Duration
+	// How long to remember that a name has no records, 0 to not remember
+	NegativeTTL time.Duration
+	// File the cache is loaded from and saved to, empty to only keep it in
+	// memory
+	Path string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	stats   CacheStats
+	// The clock, replaced in tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	Values   []string  `json:"values,omitempty"`
+	NotFound bool      `json:"not_found,omitempty"`
+	Expires  time.Time `json:"expires"`
+	// Answers cached for DefaultTTL still have an unknown TTL
+	UnknownTTL bool `json:"unknown_ttl,omitempty"`
+}
+
+type CacheStats struct {
+	Hits int
+	// Hits on names known not to exist, also counted in Hits
+	NegativeHits int
+	Misses       int
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d cache hits (%d negative), %d misses", s.Hits, s.NegativeHits, s.Misses)
+}
+
+func NewCacheQuerent(querent TXTQuerent) *CacheQuerent {
+	return &CacheQuerent{
+		Querent:     querent,
+		DefaultTTL:  5 * time.Minute,
+		NegativeTTL: 5 * time.Minute,
+		entries:     map[string]*cacheEntry{},
+		now:         time.Now,
+	}
+}
+
+func (q *CacheQuerent) clock() time.Time {
+	if q.now == nil {
+		return time.Now()
+	}
+	return q.now()
+}
+
+func (q *CacheQuerent) Unwrap() TXTQuerent {
+	return q.Querent
+}
+
+func (q *CacheQuerent) Stats() CacheStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// Reads the entries saved at Path that haven't expired yet. A missing file
+// is an empty cache.
+func (q *CacheQuerent) Load() error {
+	if q.Path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(q.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries := map[string]*cacheEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("Cannot read DNS cache %s: %s", q.Path, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock()
+	for key, entry := range entries {
+		if entry.Expires.After(now) {
+			q.entries[key] = entry
+		}
+	}
+	return nil
+}
+
+// Writes the entries that haven't expired yet to Path
+func (q *CacheQuerent) Save() error {
+	if q.Path == "" {
+		return nil
+	}
+	q.mu.Lock()
+	entries := map[string]*cacheEntry{}
+	now := q.clock()
+	for key, entry := range q.entries {
+		if entry.Expires.After(now) {
+			entries[key] = entry
+		}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(q.Path, data, 0600)
+}
+
+// Answers from the cache while they last, from the querent otherwise. The
+// TTL returned is what is left of it.
+func (q *CacheQuerent) cached(rrtype, name string, query func() ([]string, time.Duration, error)) ([]string, time.Duration, error) {
+	key := rrtype + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+
+	q.mu.Lock()
+	entry, ok := q.entries[key]
+	now := q.clock()
+	if ok && entry.Expires.After(now) {
+		q.stats.Hits++
+		if entry.NotFound {
+			q.stats.NegativeHits++
+		}
+		q.mu.Unlock()
+		if entry.NotFound {
+			return nil, 0, &net.DNSError{Err: "no such host (cached)", Name: name, IsNotFound: true}
+		}
+		var ttl time.Duration
+		if !entry.UnknownTTL {
+			// Rounded up, so never 0, which would mean unknown
+			ttl = (entry.Expires.Sub(now) + time.Second - 1).Truncate(time.Second)
+		}
+		return entry.Values, ttl, nil
+	}
+	q.stats.Misses++
+	q.mu.Unlock()
+
+	values, ttl, err := query()
+	entry = &cacheEntry{Values: values}
+	switch {
+	case IsNotFound(err) && q.NegativeTTL > 0:
+		entry.NotFound = true
+		entry.Expires = now.Add(q.NegativeTTL)
+	case err != nil:
+		return nil, 0, err
+	case ttl > 0:
+		entry.Expires = now.Add(ttl)
+	case q.DefaultTTL > 0:
+		entry.UnknownTTL = true
+		entry.Expires = now.Add(q.DefaultTTL)
+	default:
+		return values, ttl, err
+	}
+
+	q.mu.Lock()
+	if q.entries == nil {
+		q.entries = map[string]*cacheEntry{}
+	}
+	q.entries[key] = entry
+	q.mu.Unlock()
+	return values, ttl, err
+}
+
+func (q *CacheQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	return q.cached("TXT", name, func() ([]string, time.Duration, error) {
+		return queryTTL(ctx, q.Querent, name)
+	})
+}
+
+func (q *CacheQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	addrs, ttl, err := q.cached("IP", name, func() ([]string, time.Duration, error) {
+		ips, ttl, err := queryIPTTL(ctx, q.Querent, name)
+		addrs := []string{}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return addrs, ttl, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips, ttl, nil
+}
+
+func (q *CacheQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	return q.cached("MX", name, func() ([]string, time.Duration, error) {
+		return queryMXTTL(ctx, q.Querent, name)
+	})
+}
+
+func (q *CacheQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := q.QueryTTL(ctx, name)
+	return txts, err
+}
+
+func (q *CacheQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := q.QueryIPTTL(ctx, name)
+	return ips, err
+}
+
+func (q *CacheQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	hosts, _, err := q.QueryMXTTL(ctx, name)
+	return hosts, err
+}
+
+func (q *CacheQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	names, _, err := q.cached("PTR", addr, func() ([]string, time.Duration, error) {
+		names, err := q.Querent.QueryPTR(ctx, addr)
+		return names, 0, err
+	})
+	return names, err
+}
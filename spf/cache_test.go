@@ -0,0 +1,111 @@
+package spf
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheQuerent(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+	server.add("_spf.vendor.com.", dnsmessage.TypeTXT, 600, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"}})
+	server.add("mail.vendor.com.", dnsmessage.TypeA, 60, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := NewCacheQuerent(NewWireQuerent(server.addr()))
+	q.now = func() time.Time { return now }
+	asked := func() int {
+		_, recursive := server.queries()
+		return recursive
+	}
+
+	for i := 0; i < 3; i++ {
+		txts, ttl, err := q.QueryTTL(ctx, "_spf.vendor.com")
+		if err != nil || len(txts) != 1 || ttl != 10*time.Minute {
+			t.Errorf("Wrong answer: %v %s %v", txts, ttl, err)
+		}
+	}
+	if asked() != 1 {
+		t.Errorf("Should only ask once, asked %d times", asked())
+	}
+
+	// What's left of the TTL
+	now = now.Add(4 * time.Minute)
+	if _, ttl, _ := q.QueryTTL(ctx, "_spf.vendor.com"); ttl != 6*time.Minute {
+		t.Errorf("Should count down the TTL: %s", ttl)
+	}
+	if ips, _ := q.QueryIP(ctx, "mail.vendor.com"); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("Wrong IP answer: %v", ips)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Query(ctx, "missing.vendor.com"); !IsNotFound(err) {
+			t.Errorf("Should be not found: %v", err)
+		}
+	}
+	// The IP answer took an A and an AAAA query
+	if asked() != 4 {
+		t.Errorf("Should remember names that don't exist, asked %d times", asked())
+	}
+
+	now = now.Add(7 * time.Minute)
+	q.Query(ctx, "_spf.vendor.com")
+	q.Query(ctx, "missing.vendor.com")
+	if asked() != 6 {
+		t.Errorf("Should ask again once expired, asked %d times", asked())
+	}
+	stats := q.Stats()
+	if stats.Hits != 4 || stats.NegativeHits != 1 || stats.Misses != 5 {
+		t.Errorf("Wrong stats: %s", stats)
+	}
+}
+
+func TestCacheQuerentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestDNSServer(t)
+	defer server.close()
+	server.add("_spf.vendor.com.", dnsmessage.TypeTXT, 600, &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}})
+	server.add("_spf2.vendor.com.", dnsmessage.TypeTXT, 60, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ~all"}})
+
+	ctx := context.Background()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := NewCacheQuerent(NewWireQuerent(server.addr()))
+	q.Path = filepath.Join(dir, "cache.json")
+	q.now = func() time.Time { return now }
+	if err := q.Load(); err != nil {
+		t.Errorf("A missing file should be an empty cache: %s", err)
+	}
+	q.Query(ctx, "_spf.vendor.com")
+	q.Query(ctx, "_spf2.vendor.com")
+	if err := q.Save(); err != nil {
+		t.Fatalf("Cannot save: %s", err)
+	}
+
+	// Another run, after the second one expired
+	now = now.Add(2 * time.Minute)
+	q = NewCacheQuerent(NewWireQuerent(server.addr()))
+	q.Path = filepath.Join(dir, "cache.json")
+	q.now = func() time.Time { return now }
+	if err := q.Load(); err != nil {
+		t.Fatalf("Cannot load: %s", err)
+	}
+	txts, ttl, err := q.QueryTTL(ctx, "_spf.vendor.com")
+	if err != nil || len(txts) != 1 || txts[0] != "v=spf1 -all" || ttl != 8*time.Minute {
+		t.Errorf("Should answer from the file: %v %s %v", txts, ttl, err)
+	}
+	q.Query(ctx, "_spf2.vendor.com")
+	if stats := q.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expired entries shouldn't be loaded: %s", stats)
+	}
+}
@@ -0,0 +1,208 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// One of the querents a ConsensusQuerent asks, named for reports
+type Voter struct {
+	Name    string
+	Querent TXTQuerent
+}
+
+// Asks every voter, usually each with a different resolver, and only
+// accepts an answer enough of them agree on. A single poisoned or stale
+// resolver then can't change what gets flattened.
+type ConsensusQuerent struct {
+	Voters []Voter
+	// How many voters must give the same answer, a majority when 0
+	Quorum int
+	// Asked instead when there is no quorum. When nil, queries without a
+	// quorum fail with a *ConsensusError.
+	Fallback TXTQuerent
+
+	mu            sync.Mutex
+	disagreements []*ConsensusError
+}
+
+func NewConsensusQuerent(voters ...Voter) *ConsensusQuerent {
+	return &ConsensusQuerent{Voters: voters}
+}
+
+// Every query so far without a quorum, whether it failed or fell back
+func (q *ConsensusQuerent) Disagreements() []*ConsensusError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*ConsensusError{}, q.disagreements...)
+}
+
+// The disagreements of the ConsensusQuerent querent is or decorates, if any
+func Disagreements(querent TXTQuerent) []*ConsensusError {
+	for querent != nil {
+		if consensus, ok := querent.(*ConsensusQuerent); ok {
+			return consensus.Disagreements()
+		}
+		decorator, ok := querent.(interface{ Unwrap() TXTQuerent })
+		if !ok {
+			break
+		}
+		querent = decorator.Unwrap()
+	}
+	return nil
+}
+
+func (q *ConsensusQuerent) quorum() int {
+	if q.Quorum > 0 {
+		return q.Quorum
+	}
+	return len(q.Voters)/2 + 1
+}
+
+// What one voter answered
+type ballot struct {
+	value interface{}
+	// Equal for answers with the same records in any order
+	key string
+	ttl time.Duration
+	err error
+}
+
+const notFoundKey = "not found"
+
+// Asks every voter at once and returns the answer a quorum agrees on.
+// Voters that fail temporarily don't vote, if none of them can vote the
+// first of their errors is returned.
+func (q *ConsensusQuerent) vote(ctx context.Context, name, rrtype string, ask func(TXTQuerent) ballot) (ballot, error) {
+	ballots := make([]ballot, len(q.Voters))
+	var wg sync.WaitGroup
+	for i, voter := range q.Voters {
+		wg.Add(1)
+		go func(i int, querent TXTQuerent) {
+			defer wg.Done()
+			ballots[i] = ask(querent)
+			if IsNotFound(ballots[i].err) {
+				ballots[i].key = notFoundKey
+			}
+		}(i, voter.Querent)
+	}
+	wg.Wait()
+
+	counts := map[string]int{}
+	winner := -1
+	for i, b := range ballots {
+		if b.err != nil && b.key != notFoundKey {
+			continue
+		}
+		counts[b.key]++
+		if winner < 0 || counts[b.key] > counts[ballots[winner].key] {
+			winner = i
+		}
+	}
+	if winner < 0 {
+		if len(ballots) == 0 {
+			return ballot{}, fmt.Errorf("No resolvers to ask for %s", name)
+		}
+		return ballot{}, ballots[0].err
+	}
+	if counts[ballots[winner].key] >= q.quorum() {
+		result := ballots[winner]
+		for _, b := range ballots {
+			if b.key == result.key {
+				result.ttl = minTTL(result.ttl, b.ttl)
+			}
+		}
+		return result, result.err
+	}
+
+	disagreement := &ConsensusError{Name: name, Type: rrtype, Quorum: q.quorum()}
+	for i, b := range ballots {
+		answer := b.key
+		if b.err != nil && b.key != notFoundKey {
+			answer = b.err.Error()
+		}
+		disagreement.Answers = append(disagreement.Answers, VoterAnswer{q.Voters[i].Name, answer})
+	}
+	q.mu.Lock()
+	q.disagreements = append(q.disagreements, disagreement)
+	q.mu.Unlock()
+	if q.Fallback == nil {
+		return ballot{}, disagreement
+	}
+	result := ask(q.Fallback)
+	return result, result.err
+}
+
+// The same records in any order give the same key
+func answerKey(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%q", sorted)
+}
+
+func (q *ConsensusQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	result, err := q.vote(ctx, name, "TXT", func(querent TXTQuerent) ballot {
+		txts, ttl, err := queryTTL(ctx, querent, name)
+		return ballot{txts, answerKey(txts), ttl, err}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result.value.([]string), result.ttl, nil
+}
+
+func (q *ConsensusQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	result, err := q.vote(ctx, name, "A/AAAA", func(querent TXTQuerent) ballot {
+		ips, ttl, err := queryIPTTL(ctx, querent, name)
+		addrs := []string{}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return ballot{ips, answerKey(addrs), ttl, err}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result.value.([]net.IP), result.ttl, nil
+}
+
+func (q *ConsensusQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	result, err := q.vote(ctx, name, "MX", func(querent TXTQuerent) ballot {
+		hosts, ttl, err := queryMXTTL(ctx, querent, name)
+		return ballot{hosts, answerKey(hosts), ttl, err}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result.value.([]string), result.ttl, nil
+}
+
+func (q *ConsensusQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := q.QueryTTL(ctx, name)
+	return txts, err
+}
+
+func (q *ConsensusQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := q.QueryIPTTL(ctx, name)
+	return ips, err
+}
+
+func (q *ConsensusQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	hosts, _, err := q.QueryMXTTL(ctx, name)
+	return hosts, err
+}
+
+func (q *ConsensusQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	result, err := q.vote(ctx, addr, "PTR", func(querent TXTQuerent) ballot {
+		names, err := querent.QueryPTR(ctx, addr)
+		return ballot{names, answerKey(names), 0, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.value.([]string), nil
+}
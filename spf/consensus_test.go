@@ -0,0 +1,78 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func consensusVoters(answers ...[]string) []Voter {
+	voters := []Voter{}
+	for i, txts := range answers {
+		querent := &TestQuerent{txts: map[string][]string{}}
+		if txts != nil {
+			querent.txts["_spf.vendor.com"] = txts
+		}
+		voters = append(voters, Voter{Name: string(rune('a' + i)), Querent: querent})
+	}
+	return voters
+}
+
+func TestConsensusQuerent(t *testing.T) {
+	good := []string{"v=spf1 ip4:192.0.2.0/24 -all", "verification=abc"}
+	// The same records in another order
+	reordered := []string{"verification=abc", "v=spf1 ip4:192.0.2.0/24 -all"}
+	poisoned := []string{"v=spf1 ip4:0.0.0.0/0 -all"}
+	ctx := context.Background()
+
+	q := NewConsensusQuerent(consensusVoters(good, poisoned, reordered)...)
+	txts, err := q.Query(ctx, "_spf.vendor.com")
+	if err != nil || len(txts) != 2 || len(q.Disagreements()) != 0 {
+		t.Errorf("Two of three should be a quorum: %v %v", txts, err)
+	}
+
+	q = NewConsensusQuerent(consensusVoters(good, poisoned, nil)...)
+	_, err = q.Query(ctx, "_spf.vendor.com")
+	consensusErr, ok := err.(*ConsensusError)
+	if !ok {
+		t.Fatalf("Should fail without a quorum: %v", err)
+	}
+	if len(consensusErr.Answers) != 3 || consensusErr.Answers[2].Answer != notFoundKey ||
+		!strings.Contains(err.Error(), "b answered [\"v=spf1 ip4:0.0.0.0/0 -all\"]") {
+		t.Errorf("Should report every answer: %s", err)
+	}
+
+	q.Fallback = &TestQuerent{txts: map[string][]string{"_spf.vendor.com": good}}
+	txts, err = q.Query(ctx, "_spf.vendor.com")
+	if err != nil || len(txts) != 2 || len(q.Disagreements()) != 2 {
+		t.Errorf("Should fall back and keep the disagreement: %v %v %v", txts, err, q.Disagreements())
+	}
+
+	// Agreeing that a name doesn't exist is a quorum too
+	q = NewConsensusQuerent(consensusVoters(nil, nil, good)...)
+	if _, err := q.Query(ctx, "_spf.vendor.com"); !IsNotFound(err) {
+		t.Errorf("Should agree it doesn't exist: %v", err)
+	}
+
+	// Voters that can't answer don't vote
+	q = NewConsensusQuerent(consensusVoters(good, good, good)...)
+	q.Voters[2].Querent.(*TestQuerent).errs = map[string]error{"_spf.vendor.com": &net.DNSError{Err: "timeout", IsTimeout: true}}
+	if _, err := q.Query(ctx, "_spf.vendor.com"); err != nil {
+		t.Errorf("Two of three should still be a quorum: %v", err)
+	}
+	q.Quorum = 3
+	if _, err := q.Query(ctx, "_spf.vendor.com"); err == nil {
+		t.Errorf("Two can't be a quorum of three")
+	}
+}
+
+func TestFlattenConsensus(t *testing.T) {
+	voters := consensusVoters([]string{"v=spf1 ip4:192.0.2.0/24 -all"}, []string{"v=spf1 ip4:0.0.0.0/0 -all"})
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com -all")
+	r1.Querent = NewConsensusQuerent(voters...)
+	_, err := r1.Flatten(context.Background())
+	if _, ok := err.(*ConsensusError); !ok {
+		t.Errorf("Flatten should stop when the resolvers disagree: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A TXT record that doesn't start with the "v=spf1" version section.
+// Such records are discarded during lookups rather than being errors.
+type NotSPFError struct {
+	Txt string
+}
+
+func (e *NotSPFError) Error() string {
+	return "Not a valid SPF record: " + e.Txt
+}
+
+// An SPF record that breaks the RFC 7208 syntax, which receivers treat as
+// a permerror
+type ParseError struct {
+	// Where the record was published, empty for records we were handed
+	Domain string
+	// The offending term as it appears in the record
+	Term string
+	// Position of the term, the version section being 0
+	Index int
+	// Section of RFC 7208 the term breaks
+	Rule   string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("Invalid SPF term %d `%s`: %s (RFC 7208 section %s)", e.Index, e.Term, e.Reason, e.Rule)
+	if e.Domain != "" {
+		msg = e.Domain + ": " + msg
+	}
+	return msg
+}
+
+// An include or redirect that leads back to a record it came from. The path
+// starts at the record being flattened and ends with the repeated domain.
+type LoopError struct {
+	Path []string
+}
+
+func (e *LoopError) Error() string {
+	return "Include or redirect loop: " + strings.Join(e.Path, " -> ")
+}
+
+// Includes and redirects nested deeper than Flatten may follow
+type DepthError struct {
+	Path     []string
+	MaxDepth int
+}
+
+func (e *DepthError) Error() string {
+	return fmt.Sprintf("Includes and redirects nested more than %d deep: %s", e.MaxDepth, strings.Join(e.Path, " -> "))
+}
+
+// More DNS queries than one Flatten may make
+type QueryBudgetError struct {
+	// The name that would have gone over the budget
+	Name       string
+	MaxQueries int
+}
+
+func (e *QueryBudgetError) Error() string {
+	return fmt.Sprintf("More than %d DNS queries while flattening, stopped before %s", e.MaxQueries, e.Name)
+}
+
+// A query that kept failing temporarily, like with timeouts or SERVFAIL,
+// until it ran out of retries or time
+type TempError struct {
+	Name     string
+	Attempts int
+	Err      error
+}
+
+func (e *TempError) Error() string {
+	return fmt.Sprintf("Temporary DNS failure for %s after %d attempts: %s", e.Name, e.Attempts, e.Err)
+}
+
+// What one resolver answered to a query without consensus
+type VoterAnswer struct {
+	Voter  string
+	Answer string
+}
+
+// Fewer resolvers than the quorum agreed on the records of a name
+type ConsensusError struct {
+	Name string
+	// The type of records asked for, like TXT
+	Type    string
+	Quorum  int
+	Answers []VoterAnswer
+}
+
+func (e *ConsensusError) Error() string {
+	answers := []string{}
+	for _, answer := range e.Answers {
+		answers = append(answers, answer.Voter+" answered "+answer.Answer)
+	}
+	return fmt.Sprintf("Fewer than %d resolvers agree on the %s records of %s: %s", e.Quorum, e.Type, e.Name, strings.Join(answers, "; "))
+}
+
+// A name with more than one SPF record, which receivers treat as a
+// permerror (RFC 7208 section 4.5)
+type MultipleRecordsError struct {
+	Domain  string
+	Records []string
+}
+
+func (e *MultipleRecordsError) Error() string {
+	return fmt.Sprintf("%s has %d SPF records, a permerror for receivers: `%s`", e.Domain, len(e.Records), strings.Join(e.Records, "`, `"))
+}
@@ -0,0 +1,379 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-2.6
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultNeutral   Result = "neutral"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+var qualifierResults = map[Qualifier]Result{
+	QualifierPass:     ResultPass,
+	QualifierFail:     ResultFail,
+	QualifierSoftFail: ResultSoftFail,
+	QualifierNeutral:  ResultNeutral,
+}
+
+// http://tools.ietf.org/html/rfc7208#section-4.6.4
+const MAX_LOOKUPS = 10
+const MAX_VOID_LOOKUPS = 2
+
+// How one record was evaluated
+type TraceStep struct {
+	Domain string
+	// The term that decided the result, empty when none matched
+	Term   string
+	Result Result
+}
+
+type Evaluation struct {
+	Result Result
+	// Every record evaluated, outermost first
+	Trace []TraceStep
+	// Why the result is a permerror or temperror
+	Err error
+}
+
+// Holds the state of one check_host() call and everything it recurses into
+type evaluator struct {
+	ctx         context.Context
+	querent     TXTQuerent
+	ip          net.IP
+	sender      string
+	helo        string
+	lookups     int
+	voidLookups int
+	trace       []TraceStep
+}
+
+// Errors that end the evaluation with a permerror or temperror
+type evaluationError struct {
+	result Result
+	err    error
+}
+
+func (e *evaluationError) Error() string {
+	return e.err.Error()
+}
+
+func permError(format string, args ...interface{}) error {
+	return &evaluationError{ResultPermError, fmt.Errorf(format, args...)}
+}
+
+func tempError(err error) error {
+	return &evaluationError{ResultTempError, err}
+}
+
+// Would mail from sender, connecting from ip and saying helo, pass this
+// record? The record is treated as published at its Domain, or at the
+// domain of the sender when that isn't set.
+func (spf *SPF) Evaluate(ctx context.Context, ip net.IP, sender, helo string) *Evaluation {
+	e := &evaluator{ctx: ctx, querent: spf.Querent, ip: ip, sender: sender, helo: helo}
+	domain := spf.Domain
+	if domain == "" {
+		_, domain = e.senderParts()
+	}
+	return e.finish(e.evaluate(spf, domain))
+}
+
+// http://tools.ietf.org/html/rfc7208#section-4
+// Looks up the SPF record of domain and evaluates it
+func CheckHost(ctx context.Context, querent TXTQuerent, ip net.IP, domain, sender, helo string) *Evaluation {
+	e := &evaluator{ctx: ctx, querent: querent, ip: ip, sender: sender, helo: helo}
+	return e.finish(e.checkHost(domain))
+}
+
+func (e *evaluator) finish(result Result, err error) *Evaluation {
+	return &Evaluation{
+		Result: result,
+		Trace:  e.trace,
+		Err:    err,
+	}
+}
+
+func (e *evaluator) checkHost(domain string) (Result, error) {
+	step := len(e.trace)
+	e.trace = append(e.trace, TraceStep{Domain: domain})
+
+	rec, err := e.lookupRecord(domain)
+	if err != nil {
+		return e.fail(step, err)
+	}
+	if rec == nil {
+		e.trace[step].Result = ResultNone
+		return ResultNone, nil
+	}
+	// The step is filled in by evaluate
+	e.trace = e.trace[:step]
+	return e.evaluate(rec, domain)
+}
+
+// The one SPF record published at domain, nil if there is none
+func (e *evaluator) lookupRecord(domain string) (*SPF, error) {
+	txts, err := e.querent.Query(e.ctx, domain)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, tempError(err)
+	}
+
+	var rec *SPF
+	for _, txt := range txts {
+		candidate := NewSPF()
+		err := candidate.Parse(txt)
+		if _, ok := err.(*NotSPFError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, permError("%s: %s", domain, err)
+		}
+		if rec != nil {
+			return nil, permError("%s has more than one SPF record", domain)
+		}
+		rec = candidate
+	}
+	return rec, nil
+}
+
+func (e *evaluator) fail(step int, err error) (Result, error) {
+	result := ResultPermError
+	if evalErr, ok := err.(*evaluationError); ok {
+		result = evalErr.result
+	}
+	e.trace[step].Result = result
+	return result, err
+}
+
+// Evaluates the mechanisms of a record published at domain
+func (e *evaluator) evaluate(rec *SPF, domain string) (Result, error) {
+	step := len(e.trace)
+	e.trace = append(e.trace, TraceStep{Domain: domain})
+
+	for _, term := range rec.Terms {
+		if !term.Kind.IsMechanism() {
+			continue
+		}
+		matched, err := e.matches(term, domain)
+		if err != nil {
+			return e.fail(step, err)
+		}
+		if matched {
+			result := qualifierResults[term.Qualifier]
+			e.trace[step].Term = term.String()
+			e.trace[step].Result = result
+			return result, nil
+		}
+	}
+
+	redirect := rec.Values(KindRedirect)
+	if len(redirect) == 0 {
+		e.trace[step].Result = ResultNeutral
+		return ResultNeutral, nil
+	}
+
+	// http://tools.ietf.org/html/rfc7208#section-6.1
+	e.trace[step].Term = "redirect=" + redirect[0]
+	target, err := e.targetDomain(redirect[0], domain)
+	if err == nil {
+		err = e.countLookup()
+	}
+	if err != nil {
+		return e.fail(step, err)
+	}
+	result, err := e.checkHost(target)
+	if result == ResultNone {
+		result = ResultPermError
+		err = permError("redirect=%s has no SPF record", target)
+	}
+	e.trace[step].Result = result
+	return result, err
+}
+
+func (e *evaluator) countLookup() error {
+	e.lookups++
+	if e.lookups > MAX_LOOKUPS {
+		return permError("More than %d DNS lookups", MAX_LOOKUPS)
+	}
+	return nil
+}
+
+// Lookups that come back empty count against their own, lower limit
+func (e *evaluator) countVoid(found int, err error) error {
+	if err != nil && !IsNotFound(err) {
+		return tempError(err)
+	}
+	if found == 0 {
+		e.voidLookups++
+		if e.voidLookups > MAX_VOID_LOOKUPS {
+			return permError("More than %d void DNS lookups", MAX_VOID_LOOKUPS)
+		}
+	}
+	return nil
+}
+
+// The domain a mechanism or modifier refers to, with macros expanded
+func (e *evaluator) targetDomain(spec, domain string) (string, error) {
+	if spec == "" {
+		return domain, nil
+	}
+	target, err := e.expand(spec, domain)
+	if err != nil {
+		return "", permError("%s", err)
+	}
+	return target, nil
+}
+
+func (e *evaluator) matches(term Term, domain string) (bool, error) {
+	switch term.Kind {
+	case KindAll:
+		return true, nil
+	case KindIP4, KindIP6:
+		network, err := parseNetwork(term)
+		if err != nil {
+			return false, permError("%s", err)
+		}
+		return network.Contains(e.ip), nil
+	}
+
+	// Everything else needs DNS
+	if err := e.countLookup(); err != nil {
+		return false, err
+	}
+	target, err := e.targetDomain(term.Value, domain)
+	if err != nil {
+		return false, err
+	}
+
+	switch term.Kind {
+	case KindInclude:
+		// http://tools.ietf.org/html/rfc7208#section-5.2
+		result, err := e.checkHost(target)
+		switch result {
+		case ResultPass:
+			return true, nil
+		case ResultTempError, ResultPermError:
+			return false, err
+		case ResultNone:
+			return false, permError("include:%s has no SPF record", target)
+		}
+		return false, nil
+	case KindA:
+		ips, err := e.querent.QueryIP(e.ctx, target)
+		if err := e.countVoid(len(ips), err); err != nil {
+			return false, err
+		}
+		return e.matchesHost(term, ips), nil
+	case KindMX:
+		hosts, err := e.querent.QueryMX(e.ctx, target)
+		if err := e.countVoid(len(hosts), err); err != nil {
+			return false, err
+		}
+		if len(hosts) > MAX_MX_NAMES {
+			return false, permError("%s has more than %d MX records", target, MAX_MX_NAMES)
+		}
+		for _, host := range hosts {
+			ips, err := e.querent.QueryIP(e.ctx, host)
+			if err != nil && !IsNotFound(err) {
+				return false, tempError(err)
+			}
+			if e.matchesHost(term, ips) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case KindPTR:
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for _, name := range e.validatedNames() {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case KindExists:
+		ips, err := e.querent.QueryIP(e.ctx, target)
+		found := 0
+		for _, ip := range ips {
+			// exists only ever looks for A records
+			if ip.To4() != nil {
+				found++
+			}
+		}
+		if err := e.countVoid(found, err); err != nil {
+			return false, err
+		}
+		return found > 0, nil
+	}
+	return false, permError("Unknown mechanism %s", term)
+}
+
+// Whether one of the addresses of an a or mx mechanism, widened by its dual
+// CIDR lengths, holds the connecting IP
+func (e *evaluator) matchesHost(term Term, ips []net.IP) bool {
+	for _, ip := range ips {
+		// Only addresses of the connection's family count
+		if (ip.To4() == nil) != (e.ip.To4() == nil) {
+			continue
+		}
+		network, err := parseNetwork(hostTerm(term, ip))
+		if err == nil && network.Contains(e.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// http://tools.ietf.org/html/rfc7208#section-5.5
+// The names pointing back at the connecting IP whose own addresses include
+// it. Only the first 10 PTR names are looked at.
+func (e *evaluator) validatedNames() []string {
+	names, err := e.querent.QueryPTR(e.ctx, e.ip.String())
+	if err != nil {
+		return []string{}
+	}
+	if len(names) > MAX_MX_NAMES {
+		names = names[:MAX_MX_NAMES]
+	}
+	validated := []string{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		ips, err := e.querent.QueryIP(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// The p macro: a validated name, preferably in domain
+func (e *evaluator) validatedName(domain string) string {
+	names := e.validatedNames()
+	for _, name := range names {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return name
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return "unknown"
+}
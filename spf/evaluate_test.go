@@ -0,0 +1,188 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestExpandMacros(t *testing.T) {
+	// http://tools.ietf.org/html/rfc7208#section-7.4
+	e := &evaluator{
+		querent: &TestQuerent{},
+		ip:      net.ParseIP("192.0.2.3"),
+		sender:  "strong-bad@email.example.com",
+		helo:    "mx.example.org",
+	}
+	tests := map[string]string{
+		"%{s}":                            "strong-bad@email.example.com",
+		"%{o}":                            "email.example.com",
+		"%{d}":                            "email.example.com",
+		"%{d4}":                           "email.example.com",
+		"%{d3}":                           "email.example.com",
+		"%{d2}":                           "example.com",
+		"%{d1}":                           "com",
+		"%{dr}":                           "com.example.email",
+		"%{d2r}":                          "example.email",
+		"%{l}":                            "strong-bad",
+		"%{l-}":                           "strong.bad",
+		"%{lr}":                           "strong-bad",
+		"%{lr-}":                          "bad.strong",
+		"%{l1r-}":                         "strong",
+		"%{ir}.%{v}._spf.%{d2}":           "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":            "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}": "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{h}.%%.%_.%-":                   "mx.example.org.%. .%20",
+		"%{S}":                            "strong-bad%40email.example.com",
+	}
+	for spec, expected := range tests {
+		expanded, err := e.expand(spec, "email.example.com")
+		if err != nil {
+			t.Errorf("Error expanding %s: %s", spec, err)
+		}
+		if expanded != expected {
+			t.Errorf("Expanded %s to %s instead of %s", spec, expanded, expected)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	expanded, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if expanded != expected {
+		t.Errorf("Wrong IPv6 expansion: %s", expanded)
+	}
+}
+
+func testEvaluationQuerent() *TestQuerent {
+	return &TestQuerent{
+		txts: map[string][]string{
+			"example.com": []string{
+				"google-site-verification=abc",
+				"v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.66 include:_spf.vendor.com " +
+					"a:mail.example.com/28 mx ptr exists:%{ir}.allow.example.com ~all",
+			},
+			"_spf.vendor.com":  []string{"v=spf1 -ip4:198.51.100.128/25 ip4:198.51.100.0/24 redirect=_spf2.vendor.com"},
+			"_spf2.vendor.com": []string{"v=spf1 ip6:2001:db8::/32 -all"},
+		},
+		ips: map[string][]string{
+			"mail.example.com":               []string{"203.0.113.20"},
+			"mx.example.com":                 []string{"203.0.113.100"},
+			"host.example.com":               []string{"203.0.113.200"},
+			"77.113.0.203.allow.example.com": []string{"127.0.0.2"},
+		},
+		mxs: map[string][]string{
+			"example.com": []string{"mx.example.com"},
+		},
+		ptrs: map[string][]string{
+			"203.0.113.200": []string{"host.example.com."},
+			"203.0.113.201": []string{"spoofed.example.com."},
+		},
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	querent := testEvaluationQuerent()
+	tests := []struct {
+		ip     string
+		result Result
+		steps  int
+	}{
+		{"192.0.2.5", ResultPass, 1},
+		{"198.51.100.66", ResultFail, 1},
+		{"198.51.100.7", ResultPass, 2},
+		// The vendor fails it, which only means its include doesn't match
+		{"198.51.100.200", ResultSoftFail, 2},
+		{"2001:db8::1", ResultPass, 3},
+		{"203.0.113.17", ResultPass, 3},
+		{"203.0.113.100", ResultPass, 3},
+		{"203.0.113.200", ResultPass, 3},
+		{"203.0.113.201", ResultSoftFail, 3},
+		{"203.0.113.77", ResultPass, 3},
+		{"10.0.0.1", ResultSoftFail, 3},
+	}
+	for _, test := range tests {
+		eval := CheckHost(context.Background(), querent, net.ParseIP(test.ip), "example.com", "user@example.com", "mx.example.org")
+		if eval.Result != test.result {
+			t.Errorf("%s should be %s, got %s: %v %v", test.ip, test.result, eval.Result, eval.Trace, eval.Err)
+		}
+		if len(eval.Trace) != test.steps {
+			t.Errorf("%s should evaluate %d records: %v", test.ip, test.steps, eval.Trace)
+		}
+	}
+
+	eval := CheckHost(context.Background(), querent, net.ParseIP("198.51.100.7"), "example.com", "user@example.com", "")
+	expected := "[{example.com include:_spf.vendor.com pass} {_spf.vendor.com ip4:198.51.100.0/24 pass}]"
+	if fmt.Sprintf("%v", eval.Trace) != expected {
+		t.Errorf("Wrong trace: %v", eval.Trace)
+	}
+}
+
+func TestCheckHostErrors(t *testing.T) {
+	querent := &TestQuerent{
+		txts: map[string][]string{
+			"none.example.com":     []string{"not spf"},
+			"double.example.com":   []string{"v=spf1 -all", "v=spf1 ~all"},
+			"bad.example.com":      []string{"v=spf1 ip4:300.0.0.1 -all"},
+			"include.example.com":  []string{"v=spf1 include:none.example.com -all"},
+			"missing.example.com":  []string{"v=spf1 include:nowhere.example.com -all"},
+			"redirect.example.com": []string{"v=spf1 redirect=nowhere.example.com"},
+			"void.example.com":     []string{"v=spf1 a:a.example.com a:b.example.com a:c.example.com -all"},
+			"temp.example.com":     []string{"v=spf1 include:servfail.example.com -all"},
+			"neutral.example.com":  []string{"v=spf1 ip4:192.0.2.1"},
+			"loop.example.com":     []string{"v=spf1 include:loop.example.com -all"},
+		},
+		errs: map[string]error{
+			"servfail.example.com": &net.DNSError{Err: "server misbehaving", Name: "servfail.example.com", IsTemporary: true},
+		},
+	}
+	tests := map[string]Result{
+		"none.example.com":     ResultNone,
+		"nowhere.example.com":  ResultNone,
+		"double.example.com":   ResultPermError,
+		"bad.example.com":      ResultPermError,
+		"include.example.com":  ResultPermError,
+		"missing.example.com":  ResultPermError,
+		"redirect.example.com": ResultPermError,
+		"void.example.com":     ResultPermError,
+		"temp.example.com":     ResultTempError,
+		"neutral.example.com":  ResultNeutral,
+		"loop.example.com":     ResultPermError,
+	}
+	for domain, result := range tests {
+		eval := CheckHost(context.Background(), querent, net.ParseIP("10.0.0.1"), domain, "", "mx.example.org")
+		if eval.Result != result {
+			t.Errorf("%s should be %s, got %s: %v", domain, result, eval.Result, eval.Err)
+		}
+		if (result == ResultPermError || result == ResultTempError) && eval.Err == nil {
+			t.Errorf("%s should explain the %s", domain, result)
+		}
+	}
+}
+
+func TestFlattenEvaluatesTheSame(t *testing.T) {
+	querent := testEvaluationQuerent()
+	ideal := mustParse(t, querent.txts["example.com"][1])
+	// ptr and exists can't be flattened
+	ideal.Terms = append(ideal.Terms[:5], ideal.Terms[7:]...)
+	ideal.Domain = "example.com"
+	ideal.Querent = querent
+	flat, err := ideal.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	// include, its redirect, a and mx
+	if flat.LookupCount != 4 {
+		t.Errorf("Wrong lookup count: %d", flat.LookupCount)
+	}
+
+	ips := []string{"192.0.2.5", "198.51.100.66", "198.51.100.7", "198.51.100.200", "2001:db8::1",
+		"203.0.113.17", "203.0.113.100", "203.0.113.200", "10.0.0.1", "2001:db9::1"}
+	for _, ip := range ips {
+		before := ideal.Evaluate(context.Background(), net.ParseIP(ip), "", "mx.example.org")
+		after := flat.Evaluate(context.Background(), net.ParseIP(ip), "", "mx.example.org")
+		if before.Result != after.Result {
+			t.Errorf("%s is %s before flattening but %s after: %s", ip, before.Result, after.Result, flat.AsTXTRecord())
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package spf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The records at one name in a fixture
+type FixtureRecords struct {
+	TXT  []string `json:"txt,omitempty"`
+	A    []string `json:"a,omitempty"`
+	AAAA []string `json:"aaaa,omitempty"`
+	// Exchange hosts, most preferred first
+	MX []string `json:"mx,omitempty"`
+	// In seconds by record type, the lowest of the records of that type.
+	// Types without one have an unknown TTL.
+	TTLs map[string]uint32 `json:"ttls,omitempty"`
+}
+
+// The TTL of the records of one type, 0 when unknown
+func (r *FixtureRecords) ttl(rrtype string) time.Duration {
+	return time.Duration(r.TTLs[rrtype]) * time.Second
+}
+
+// Keeps the lowest TTL given for a type
+func (r *FixtureRecords) addTTL(rrtype string, seconds uint32) {
+	if seconds == 0 {
+		return
+	}
+	if r.TTLs == nil {
+		r.TTLs = map[string]uint32{}
+	}
+	if current, ok := r.TTLs[rrtype]; !ok || seconds < current {
+		r.TTLs[rrtype] = seconds
+	}
+}
+
+// A snapshot of DNS answers, by name without the trailing dot
+type Fixture struct {
+	Records map[string]*FixtureRecords `json:"records"`
+}
+
+func NewFixture() *Fixture {
+	return &Fixture{Records: map[string]*FixtureRecords{}}
+}
+
+func fixtureName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (f *Fixture) records(name string) *FixtureRecords {
+	name = fixtureName(name)
+	records, ok := f.Records[name]
+	if !ok {
+		records = &FixtureRecords{}
+		f.Records[name] = records
+	}
+	return records
+}
+
+// Reads a fixture in JSON when path ends in .json, as a zone file otherwise
+func LoadFixture(path string) (*Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if strings.HasSuffix(path, ".json") {
+		return ReadFixtureJSON(file)
+	}
+	return ReadZone(file)
+}
+
+// Writes a fixture in JSON when path ends in .json, as a zone file otherwise
+func (f *Fixture) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".json") {
+		err = f.WriteJSON(file)
+	} else {
+		err = f.WriteZone(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func ReadFixtureJSON(r io.Reader) (*Fixture, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	f := NewFixture()
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	// Names are looked up the way records() stores them
+	records := f.Records
+	f.Records = map[string]*FixtureRecords{}
+	for name, rrs := range records {
+		f.Records[fixtureName(name)] = rrs
+	}
+	return f, nil
+}
+
+func (f *Fixture) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Writes the fixture as a zone file ReadZone reads back, names in order
+func (f *Fixture) WriteZone(w io.Writer) error {
+	names := []string{}
+	for name := range f.Records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		records := f.Records[name]
+		owner := name + "."
+		ttl := func(rrtype string) string {
+			if seconds := records.TTLs[rrtype]; seconds > 0 {
+				return strconv.FormatUint(uint64(seconds), 10) + " "
+			}
+			return ""
+		}
+		for _, txt := range records.TXT {
+			fmt.Fprintf(buf, "%s %sIN TXT %s\n", owner, ttl("TXT"), quoteStrings(TXTStrings(txt)))
+		}
+		for _, a := range records.A {
+			fmt.Fprintf(buf, "%s %sIN A %s\n", owner, ttl("A"), a)
+		}
+		for _, aaaa := range records.AAAA {
+			fmt.Fprintf(buf, "%s %sIN AAAA %s\n", owner, ttl("AAAA"), aaaa)
+		}
+		for i, mx := range records.MX {
+			fmt.Fprintf(buf, "%s %sIN MX %d %s.\n", owner, ttl("MX"), (i+1)*10, strings.TrimSuffix(mx, "."))
+		}
+	}
+	return buf.Flush()
+}
+
+// Reads the TXT, A, AAAA and MX records of a zone file (RFC 1035 section
+// 5), along with the $ORIGIN and $TTL directives. Other record types are
+// skipped.
+func ReadZone(r io.Reader) (*Fixture, error) {
+	f := NewFixture()
+	origin := ""
+	var defaultTTL uint64
+	owner := ""
+	// MX preferences only matter while reading, for the order of the hosts
+	mxPrefs := map[string][]uint64{}
+	lines, err := zoneLines(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		fields := line.fields
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return nil, line.errorf("$ORIGIN takes a domain name")
+			}
+			origin = fixtureName(fields[1])
+			continue
+		case "$TTL":
+			ttl, err := strconv.ParseUint(fields[len(fields)-1], 10, 32)
+			if len(fields) != 2 || err != nil {
+				return nil, line.errorf("$TTL takes a number of seconds")
+			}
+			defaultTTL = ttl
+			continue
+		}
+
+		// A line starting with blanks belongs to the previous owner
+		if !line.continued {
+			owner = zoneName(fields[0], origin)
+			fields = fields[1:]
+		}
+		if owner == "" {
+			return nil, line.errorf("No owner name")
+		}
+		ttl := defaultTTL
+		for len(fields) > 0 {
+			if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				ttl = n
+			} else if strings.ToUpper(fields[0]) != "IN" {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, line.errorf("No record type")
+		}
+
+		rrtype, rdata := strings.ToUpper(fields[0]), fields[1:]
+		records := f.records(owner)
+		switch rrtype {
+		case "TXT":
+			if len(rdata) == 0 {
+				return nil, line.errorf("TXT without text")
+			}
+			records.TXT = append(records.TXT, strings.Join(rdata, ""))
+		case "A", "AAAA":
+			ip := net.ParseIP(strings.Join(rdata, ""))
+			if len(rdata) != 1 || ip == nil || (ip.To4() != nil) != (rrtype == "A") {
+				return nil, line.errorf("Invalid %s address %s", rrtype, strings.Join(rdata, " "))
+			}
+			if rrtype == "A" {
+				records.A = append(records.A, ip.String())
+			} else {
+				records.AAAA = append(records.AAAA, ip.String())
+			}
+		case "MX":
+			if len(rdata) != 2 {
+				return nil, line.errorf("MX takes a preference and a host")
+			}
+			pref, err := strconv.ParseUint(rdata[0], 10, 16)
+			if err != nil {
+				return nil, line.errorf("Invalid MX preference %s", rdata[0])
+			}
+			records.MX, mxPrefs[owner] = insertMX(records.MX, mxPrefs[owner], zoneName(rdata[1], origin), pref)
+		default:
+			// Nothing in SPF looks at other types
+			if len(records.TXT)+len(records.A)+len(records.AAAA)+len(records.MX) == 0 {
+				delete(f.Records, owner)
+			}
+			continue
+		}
+		records.addTTL(rrtype, uint32(ttl))
+	}
+	return f, nil
+}
+
+type zoneLine struct {
+	number int
+	// Starts with blanks, so has no owner name
+	continued bool
+	fields    []string
+}
+
+func (l *zoneLine) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Zone file line %d: %s", l.number, fmt.Sprintf(format, args...))
+}
+
+// Inserts host in preference order, keeping prefs in step with hosts
+func insertMX(hosts []string, prefs []uint64, host string, pref uint64) ([]string, []uint64) {
+	i := sort.Search(len(prefs), func(i int) bool { return prefs[i] > pref })
+	hosts = append(hosts, "")
+	copy(hosts[i+1:], hosts[i:])
+	hosts[i] = host
+	prefs = append(prefs, 0)
+	copy(prefs[i+1:], prefs[i:])
+	prefs[i] = pref
+	return hosts, prefs
+}
+
+// Relative names are in origin, @ is origin itself
+func zoneName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return fixtureName(name)
+	case origin == "":
+		return fixtureName(name)
+	}
+	return fixtureName(name + "." + origin)
+}
+
+// Splits a zone file into logical lines of fields, joining lines within
+// parentheses, dropping comments and unquoting character-strings
+func zoneLines(r io.Reader) ([]*zoneLine, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := []*zoneLine{}
+	line := &zoneLine{number: 1}
+	number := 1
+	depth := 0
+	text := string(data)
+	atStart := true
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			number++
+			i++
+			if depth == 0 {
+				lines = append(lines, line)
+				line = &zoneLine{number: number}
+				atStart = true
+			}
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			if atStart && len(line.fields) == 0 && depth == 0 {
+				line.continued = true
+			}
+			i++
+		case c == ';':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			if depth == 0 {
+				return nil, line.errorf("Unbalanced parentheses")
+			}
+			depth--
+			i++
+		case c == '"':
+			s, n, err := unquoteZone(text[i:])
+			if err != nil {
+				return nil, line.errorf("%s", err)
+			}
+			line.fields = append(line.fields, s)
+			i += n
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\r\n;()\"", rune(text[j])) {
+				j++
+			}
+			line.fields = append(line.fields, text[i:j])
+			i = j
+		}
+		atStart = false
+	}
+	if depth != 0 {
+		return nil, line.errorf("Unbalanced parentheses")
+	}
+	return append(lines, line), nil
+}
+
+// A quoted character-string at the start of s and how long it was, with
+// \X and \DDD escapes undone
+func unquoteZone(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				b.WriteByte(byte(n))
+				i += 3
+			} else if i+1 < len(s) {
+				b.WriteByte(s[i+1])
+				i++
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("Unterminated quoted string")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Serves answers from a Fixture. With a Live querent it records instead,
+// asking that and adding its answers to the Fixture, which can be saved
+// and replayed later to flatten exactly the same way.
+type FixtureQuerent struct {
+	Fixture *Fixture
+	Live    TXTQuerent
+
+	mu sync.Mutex
+}
+
+// Replays a fixture
+func NewFixtureQuerent(fixture *Fixture) *FixtureQuerent {
+	return &FixtureQuerent{Fixture: fixture}
+}
+
+// Records what live answers into an empty fixture
+func NewRecordingQuerent(live TXTQuerent) *FixtureQuerent {
+	return &FixtureQuerent{Fixture: NewFixture(), Live: live}
+}
+
+func (q *FixtureQuerent) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// The records at name, nil if the fixture has none of the kind asked for
+func (q *FixtureQuerent) lookup(name string, kind func(*FixtureRecords) int) *FixtureRecords {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	records, ok := q.Fixture.Records[fixtureName(name)]
+	if !ok || kind(records) == 0 {
+		return nil
+	}
+	return records
+}
+
+// Adds live answers to the fixture, with their TTL for the record types add
+// returns. Names that don't exist are left out, which replays the same way.
+func (q *FixtureQuerent) record(name string, ttl time.Duration, add func(*FixtureRecords) []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	records := q.Fixture.records(name)
+	for _, rrtype := range add(records) {
+		records.addTTL(rrtype, uint32(ttl/time.Second))
+	}
+}
+
+func (q *FixtureQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	if q.Live != nil {
+		txts, ttl, err := queryTTL(ctx, q.Live, name)
+		if err == nil {
+			q.record(name, ttl, func(r *FixtureRecords) []string {
+				r.TXT = txts
+				return []string{"TXT"}
+			})
+		}
+		return txts, ttl, err
+	}
+	records := q.lookup(name, func(r *FixtureRecords) int { return len(r.TXT) })
+	if records == nil {
+		return nil, 0, q.notFound(name)
+	}
+	return records.TXT, records.ttl("TXT"), nil
+}
+
+func (q *FixtureQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if q.Live != nil {
+		ips, ttl, err := queryIPTTL(ctx, q.Live, name)
+		if err == nil {
+			q.record(name, ttl, func(r *FixtureRecords) []string {
+				r.A, r.AAAA = nil, nil
+				for _, ip := range ips {
+					if ip.To4() != nil {
+						r.A = append(r.A, ip.String())
+					} else {
+						r.AAAA = append(r.AAAA, ip.String())
+					}
+				}
+				// Both came in one answer, with one TTL
+				rrtypes := []string{}
+				if len(r.A) > 0 {
+					rrtypes = append(rrtypes, "A")
+				}
+				if len(r.AAAA) > 0 {
+					rrtypes = append(rrtypes, "AAAA")
+				}
+				return rrtypes
+			})
+		}
+		return ips, ttl, err
+	}
+	records := q.lookup(name, func(r *FixtureRecords) int { return len(r.A) + len(r.AAAA) })
+	if records == nil {
+		return nil, 0, q.notFound(name)
+	}
+	ttl := time.Duration(0)
+	if len(records.A) > 0 {
+		ttl = records.ttl("A")
+	}
+	if len(records.AAAA) > 0 {
+		ttl = minTTL(ttl, records.ttl("AAAA"))
+	}
+	ips := []net.IP{}
+	for _, addr := range append(append([]string{}, records.A...), records.AAAA...) {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips, ttl, nil
+}
+
+func (q *FixtureQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	if q.Live != nil {
+		hosts, ttl, err := queryMXTTL(ctx, q.Live, name)
+		if err == nil {
+			q.record(name, ttl, func(r *FixtureRecords) []string {
+				r.MX = hosts
+				return []string{"MX"}
+			})
+		}
+		return hosts, ttl, err
+	}
+	records := q.lookup(name, func(r *FixtureRecords) int { return len(r.MX) })
+	if records == nil {
+		return nil, 0, q.notFound(name)
+	}
+	return records.MX, records.ttl("MX"), nil
+}
+
+func (q *FixtureQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := q.QueryTTL(ctx, name)
+	return txts, err
+}
+
+func (q *FixtureQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := q.QueryIPTTL(ctx, name)
+	return ips, err
+}
+
+func (q *FixtureQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	hosts, _, err := q.QueryMXTTL(ctx, name)
+	return hosts, err
+}
+
+// Fixtures hold no PTR records, flattening never needs them
+func (q *FixtureQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	if q.Live != nil {
+		return q.Live.QueryPTR(ctx, addr)
+	}
+	return nil, q.notFound(addr)
+}
@@ -0,0 +1,124 @@
+package spf
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadZone(t *testing.T) {
+	f, err := LoadFixture(filepath.Join("testdata", "vendors.zone"))
+	if err != nil {
+		t.Fatalf("Cannot read zone: %s", err)
+	}
+	spf := f.Records["_spf.vendor.com"]
+	if spf == nil || len(spf.TXT) != 2 || spf.TTLs["TXT"] != 3600 {
+		t.Errorf("Wrong records at _spf.vendor.com: %+v", spf)
+	}
+	spf2 := f.Records["_spf2.vendor.com"]
+	if spf2 == nil || len(spf2.TXT) != 1 || spf2.TXT[0] != "v=spf1 ip6:2001:db8::/48 ip4:198.51.100.0/24 -all" || spf2.TTLs["TXT"] != 300 {
+		t.Errorf("Character-strings should be joined: %+v", spf2)
+	}
+	if mx := f.Records["vendor.com"]; mx == nil || !reflect.DeepEqual(mx.MX, []string{"mx1.vendor.com", "mx2.vendor.com"}) {
+		t.Errorf("MX hosts should be in preference order: %+v", mx)
+	}
+	if mx2 := f.Records["mx2.vendor.com"]; mx2 == nil || len(mx2.A) != 1 || len(mx2.AAAA) != 1 {
+		t.Errorf("Wrong records at mx2.vendor.com: %+v", mx2)
+	}
+	if other := f.Records["mail.other.com"]; other == nil || other.A[0] != "203.0.113.10" {
+		t.Errorf("Wrong records at mail.other.com: %+v", other)
+	}
+
+	if _, err := ReadZone(bytes.NewBufferString("_spf IN TXT \"v=spf1 -all\"\n")); err != nil {
+		t.Errorf("Names without an origin are absolute: %s", err)
+	}
+	for _, bad := range []string{"a.com. IN A 2001:db8::1", "a.com. IN MX mx.a.com.", "a.com. IN TXT (\"v=spf1\"", "  IN TXT \"x\""} {
+		if _, err := ReadZone(bytes.NewBufferString(bad)); err == nil {
+			t.Errorf("Should not read `%s`", bad)
+		}
+	}
+}
+
+func TestFixtureQuerent(t *testing.T) {
+	f, err := LoadFixture(filepath.Join("testdata", "vendors.zone"))
+	if err != nil {
+		t.Fatalf("Cannot read zone: %s", err)
+	}
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com include:_spf.other.com -all")
+	r1.Querent = NewFixtureQuerent(f)
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	expected := "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/48 ip4:198.51.100.0/24 ip4:203.0.113.1 ip4:203.0.113.2 ip6:2001:db8:1::2 ip4:203.0.113.10 -all"
+	if flat.AsTXTRecord() != expected || flat.TTL != 5*time.Minute {
+		t.Errorf("Wrong flattened record: %s %s", flat.AsTXTRecord(), flat.TTL)
+	}
+	if _, err := r1.Querent.Query(context.Background(), "missing.vendor.com"); !IsNotFound(err) {
+		t.Errorf("Names not in the fixture should be not found: %v", err)
+	}
+
+	// Recording the replay gives the same fixture back
+	recorder := NewRecordingQuerent(NewFixtureQuerent(f))
+	r1.Querent = recorder
+	if _, err := r1.Flatten(context.Background()); err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	var zone bytes.Buffer
+	if err := recorder.Fixture.WriteZone(&zone); err != nil {
+		t.Fatalf("Cannot write zone: %s", err)
+	}
+	replayed, err := ReadZone(&zone)
+	if err != nil {
+		t.Fatalf("Cannot read written zone: %s\n%s", err, zone.String())
+	}
+	r1.Querent = NewFixtureQuerent(replayed)
+	again, err := r1.Flatten(context.Background())
+	if err != nil || again.AsTXTRecord() != expected || again.TTL != flat.TTL {
+		t.Errorf("Replaying the recording should flatten the same: %v %v", again, err)
+	}
+
+	var data bytes.Buffer
+	if err := recorder.Fixture.WriteJSON(&data); err != nil {
+		t.Fatalf("Cannot write JSON: %s", err)
+	}
+	fromJSON, err := ReadFixtureJSON(&data)
+	if err != nil || !reflect.DeepEqual(fromJSON.Records, recorder.Fixture.Records) {
+		t.Errorf("JSON should read back the same: %v", err)
+	}
+}
+
+func TestFixtureTTLs(t *testing.T) {
+	zone := "_spf.example.com. 300 IN TXT \"v=spf1 a -all\"\n" +
+		"_spf.example.com. 3600 IN A 192.0.2.1\n" +
+		"_spf.example.com. 60 IN AAAA 2001:db8::1\n"
+	f, err := ReadZone(bytes.NewBufferString(zone))
+	if err != nil {
+		t.Fatalf("Cannot read zone: %s", err)
+	}
+
+	// Recording the replay answers the same and keeps each type's TTL
+	recorder := NewRecordingQuerent(NewFixtureQuerent(f))
+	for _, querent := range []*FixtureQuerent{NewFixtureQuerent(f), recorder} {
+		if _, ttl, err := querent.QueryTTL(context.Background(), "_spf.example.com"); err != nil || ttl != 5*time.Minute {
+			t.Errorf("TXT should have its own TTL: %s %v", ttl, err)
+		}
+		if _, ttl, err := querent.QueryIPTTL(context.Background(), "_spf.example.com"); err != nil || ttl != time.Minute {
+			t.Errorf("Addresses should have the lowest of the A and AAAA TTLs: %s %v", ttl, err)
+		}
+	}
+	var written bytes.Buffer
+	if err := recorder.Fixture.WriteZone(&written); err != nil {
+		t.Fatalf("Cannot write zone: %s", err)
+	}
+	replayed, err := ReadZone(&written)
+	if err != nil {
+		t.Fatalf("Cannot read written zone: %s", err)
+	}
+	if ttls := replayed.Records["_spf.example.com"].TTLs; ttls["TXT"] != 300 || ttls["A"] != 60 || ttls["AAAA"] != 60 {
+		t.Errorf("Wrong TTLs after recording: %v", ttls)
+	}
+}
@@ -0,0 +1,229 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-4.6.4
+// How many DNS lookups receivers make evaluating a record, broken down by
+// the include and redirect branches that cause them
+type Lookups struct {
+	Domain string
+	// The include or redirect that led here, empty for the record itself
+	Term string
+	// Lookups made by the terms of this record itself
+	Lookups int
+	// Lookups that found nothing, which have a limit of their own
+	VoidLookups int
+	// The lowest TTL of the answers counted here and in the branches, 0
+	// when not known
+	TTL time.Duration
+	// Terms that break a limit on their own, or couldn't be followed
+	Problems []string
+	Branches []*Lookups
+}
+
+// Every lookup of the record and the records it leads to
+func (l *Lookups) Total() int {
+	total := l.Lookups
+	for _, branch := range l.Branches {
+		total += branch.Total()
+	}
+	return total
+}
+
+func (l *Lookups) TotalVoid() int {
+	total := l.VoidLookups
+	for _, branch := range l.Branches {
+		total += branch.TotalVoid()
+	}
+	return total
+}
+
+// Why receivers would fail to evaluate the record, if they would
+func (l *Lookups) Exceeded() []string {
+	reasons := []string{}
+	if total := l.Total(); total > MAX_LOOKUPS {
+		reasons = append(reasons, fmt.Sprintf("%d DNS lookups, more than the limit of %d", total, MAX_LOOKUPS))
+	}
+	if void := l.TotalVoid(); void > MAX_VOID_LOOKUPS {
+		reasons = append(reasons, fmt.Sprintf("%d void DNS lookups, more than the limit of %d", void, MAX_VOID_LOOKUPS))
+	}
+	return append(reasons, l.problems()...)
+}
+
+func (l *Lookups) problems() []string {
+	problems := []string{}
+	for _, problem := range l.Problems {
+		problems = append(problems, l.Domain+": "+problem)
+	}
+	for _, branch := range l.Branches {
+		problems = append(problems, branch.problems()...)
+	}
+	return problems
+}
+
+// One line per record, indented by depth
+func (l *Lookups) String() string {
+	return strings.Join(l.lines(""), "\n")
+}
+
+func (l *Lookups) lines(indent string) []string {
+	line := indent
+	if l.Term != "" {
+		line += l.Term + " -> "
+	}
+	line += fmt.Sprintf("%s: %d lookups, %d of them here, %d void", l.Domain, l.Total(), l.Lookups, l.VoidLookups)
+	lines := []string{line}
+	for _, branch := range l.Branches {
+		lines = append(lines, branch.lines(indent+"  ")...)
+	}
+	return lines
+}
+
+// Counts the lookups of every term that queries DNS, at every depth,
+// without needing a connecting IP. Lookups that depend on one, like the
+// names of a ptr, are counted once. Records are looked up with the Querent
+// the way Flatten does, within MaxQueries, and a and mx without a
+// domain-spec refer to Domain.
+func (spf *SPF) CountLookups(ctx context.Context) (*Lookups, error) {
+	chain := []string{}
+	if spf.Domain != "" {
+		chain = append(chain, spf.Domain)
+	}
+	r := newResolver(ctx, spf.Querent, spf.Concurrency, spf.MaxQueries)
+	return spf.countLookups(r, spf.Domain, "", chain)
+}
+
+// The chain of domains that led here stops include and redirect loops
+func (spf *SPF) countLookups(r *resolver, domain, via string, chain []string) (*Lookups, error) {
+	l := &Lookups{
+		Domain:   domain,
+		Term:     via,
+		Problems: []string{},
+		Branches: []*Lookups{},
+	}
+
+	hasAll := false
+	for _, term := range spf.Terms {
+		if !term.Kind.IsMechanism() || hasAll {
+			continue
+		}
+		switch term.Kind {
+		case KindAll:
+			// Nothing after all is ever evaluated
+			hasAll = true
+		case KindInclude:
+			l.Lookups++
+			if err := spf.countBranch(r, l, term, chain); err != nil {
+				return nil, err
+			}
+		case KindA, KindMX, KindExists:
+			l.Lookups++
+			target := term.Value
+			if target == "" {
+				target = domain
+			}
+			if target == "" || strings.Contains(target, "%") {
+				// Depends on the message being checked
+				continue
+			}
+			var found int
+			var ttl time.Duration
+			var err error
+			if term.Kind == KindMX {
+				var hosts []string
+				hosts, ttl, err = r.mx(target)
+				found = len(hosts)
+				if found > MAX_MX_NAMES {
+					l.Problems = append(l.Problems, fmt.Sprintf("%s has %d MX records, more than the limit of %d", term, found, MAX_MX_NAMES))
+				}
+			} else {
+				var ips []net.IP
+				ips, ttl, err = r.ip(target)
+				for _, ip := range ips {
+					// exists only ever looks for A records
+					if term.Kind == KindA || ip.To4() != nil {
+						found++
+					}
+				}
+			}
+			if err != nil && !IsNotFound(err) {
+				return nil, fmt.Errorf("Counting lookups of %s: %s", term, err)
+			}
+			l.TTL = minTTL(l.TTL, ttl)
+			if found == 0 {
+				l.VoidLookups++
+			}
+		case KindPTR:
+			// Up to MAX_MX_NAMES names are validated, but which depends on
+			// the connecting IP
+			l.Lookups++
+		}
+	}
+
+	redirect := spf.Values(KindRedirect)
+	if !hasAll && len(redirect) > 0 {
+		l.Lookups++
+		if err := spf.countBranch(r, l, NewTerm(QualifierPass, KindRedirect, redirect[0]), chain); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Looks up the record an include or redirect leads to and counts its
+// lookups as a branch of l
+func (spf *SPF) countBranch(r *resolver, l *Lookups, term Term, chain []string) error {
+	target := term.Value
+	if strings.Contains(target, "%") {
+		l.Problems = append(l.Problems, "Cannot follow macros in "+term.String())
+		return nil
+	}
+	if strInSlice(target, chain) {
+		l.Problems = append(l.Problems, fmt.Sprintf("Loop: %s -> %s", strings.Join(chain, " -> "), target))
+		return nil
+	}
+
+	txts, ttl, err := r.txt(target)
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("Counting lookups of %s: %s", term, err)
+	}
+	l.TTL = minTTL(l.TTL, ttl)
+	var rec *SPF
+	for _, txt := range txts {
+		candidate := spf.child()
+		err := candidate.Parse(txt)
+		if _, ok := err.(*NotSPFError); ok {
+			continue
+		}
+		if err != nil {
+			l.Problems = append(l.Problems, fmt.Sprintf("%s: %s", term, err))
+			return nil
+		}
+		if rec != nil {
+			l.Problems = append(l.Problems, term.String()+" has more than one SPF record")
+			return nil
+		}
+		rec = candidate
+	}
+	if rec == nil {
+		if len(txts) == 0 {
+			l.VoidLookups++
+		}
+		l.Problems = append(l.Problems, term.String()+" has no SPF record")
+		return nil
+	}
+
+	branch, err := rec.countLookups(r, target, term.String(), append(chain, target))
+	if err != nil {
+		return err
+	}
+	l.Branches = append(l.Branches, branch)
+	l.TTL = minTTL(l.TTL, branch.TTL)
+	return nil
+}
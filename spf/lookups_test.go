@@ -0,0 +1,127 @@
+package spf
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCountLookups(t *testing.T) {
+	querent := testEvaluationQuerent()
+	rec := mustParse(t, querent.txts["example.com"][1])
+	rec.Domain = "example.com"
+	rec.Querent = querent
+	lookups, err := rec.CountLookups(context.Background())
+	if err != nil {
+		t.Fatalf("Error counting lookups: %s", err)
+	}
+	// include, a, mx, ptr and exists here, redirect in the include
+	if lookups.Total() != 6 || lookups.Lookups != 5 || lookups.TotalVoid() != 0 {
+		t.Errorf("Wrong lookups:\n%s", lookups)
+	}
+	expected := "example.com: 6 lookups, 5 of them here, 0 void\n" +
+		"  include:_spf.vendor.com -> _spf.vendor.com: 1 lookups, 1 of them here, 0 void\n" +
+		"    redirect=_spf2.vendor.com -> _spf2.vendor.com: 0 lookups, 0 of them here, 0 void"
+	if lookups.String() != expected {
+		t.Errorf("Wrong breakdown:\n%s", lookups)
+	}
+	if exceeded := lookups.Exceeded(); len(exceeded) != 0 {
+		t.Errorf("Should be within limits: %v", exceeded)
+	}
+}
+
+func TestCountLookupsExceeded(t *testing.T) {
+	mxs := []string{}
+	for i := 0; i < 11; i++ {
+		mxs = append(mxs, "mx.example.com")
+	}
+	querent := &TestQuerent{
+		txts: map[string][]string{
+			"_spf.example.com":  []string{"v=spf1 a:a.example.com a:b.example.com a:c.example.com a:d.example.com ~all"},
+			"_spf2.example.com": []string{"v=spf1 a:e.example.com a:f.example.com redirect=_spf3.example.com"},
+			"_spf3.example.com": []string{"v=spf1 include:_spf2.example.com mx:big.example.com -all"},
+			"_spf4.example.com": []string{"v=spf1 -all", "v=spf1 +all"},
+		},
+		ips: map[string][]string{
+			"a.example.com": []string{"192.0.2.1"},
+		},
+		mxs: map[string][]string{
+			"big.example.com": mxs,
+		},
+	}
+	rec := mustParse(t, "v=spf1 include:_spf.example.com include:_spf2.example.com include:_spf4.example.com include:%{d}.example.com -all")
+	rec.Domain = "example.com"
+	rec.Querent = querent
+	lookups, err := rec.CountLookups(context.Background())
+	if err != nil {
+		t.Fatalf("Error counting lookups: %s", err)
+	}
+	// 4 includes, 4 a in the first, 2 a and a redirect in the second, its
+	// include and mx
+	if lookups.Total() != 13 {
+		t.Errorf("Wrong lookups:\n%s", lookups)
+	}
+	// b, c, d, e and f have no addresses
+	if lookups.TotalVoid() != 5 {
+		t.Errorf("Wrong void lookups:\n%s", lookups)
+	}
+	expected := []string{
+		"13 DNS lookups, more than the limit of 10",
+		"5 void DNS lookups, more than the limit of 2",
+		"example.com: include:_spf4.example.com has more than one SPF record",
+		"example.com: Cannot follow macros in include:%{d}.example.com",
+		"_spf3.example.com: Loop: example.com -> _spf2.example.com -> _spf3.example.com -> _spf2.example.com",
+		"_spf3.example.com: mx:big.example.com has 11 MX records, more than the limit of 10",
+	}
+	exceeded := lookups.Exceeded()
+	if len(exceeded) != len(expected) {
+		t.Fatalf("Wrong reasons: %v", exceeded)
+	}
+	for i := range expected {
+		if exceeded[i] != expected[i] {
+			t.Errorf("Wrong reason %d: %s", i, exceeded[i])
+		}
+	}
+}
+
+func TestCountLookupsExistsVoid(t *testing.T) {
+	querent := &TestQuerent{
+		ips: map[string][]string{
+			"v6.example.com": []string{"2001:db8::1"},
+		},
+	}
+	rec := mustParse(t, "v=spf1 a:v6.example.com exists:v6.example.com -all")
+	rec.Domain = "example.com"
+	rec.Querent = querent
+	lookups, err := rec.CountLookups(context.Background())
+	if err != nil {
+		t.Fatalf("Error counting lookups: %s", err)
+	}
+	// An AAAA record doesn't satisfy exists, so only it is void
+	if lookups.VoidLookups != 1 {
+		t.Errorf("Should count one void lookup, instead got:\n%s", lookups)
+	}
+}
+
+func TestCountLookupsBudget(t *testing.T) {
+	querent := &TestQuerent{
+		ips: map[string][]string{
+			"mail.example.com":  []string{"192.0.2.1"},
+			"mail2.example.com": []string{"192.0.2.2"},
+		},
+	}
+	// The same name is only queried once
+	rec := mustParse(t, "v=spf1 a:mail.example.com a:mail.example.com -all")
+	rec.Querent = querent
+	rec.MaxQueries = 1
+	if _, err := rec.CountLookups(context.Background()); err != nil {
+		t.Errorf("Error counting lookups: %s", err)
+	}
+
+	rec = mustParse(t, "v=spf1 a:mail.example.com a:mail2.example.com -all")
+	rec.Querent = querent
+	rec.MaxQueries = 1
+	if _, err := rec.CountLookups(context.Background()); err == nil || !strings.Contains(err.Error(), "mail2.example.com") {
+		t.Errorf("Should stop at the query budget, instead got %v", err)
+	}
+}
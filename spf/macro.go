@@ -0,0 +1,132 @@
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-7
+var macroRe = regexp.MustCompile(`%\{([a-zA-Z])([0-9]*)([rR]?)([.\-+,/_=]*)\}|%%|%_|%-`)
+
+// Domain names longer than this get their leftmost labels dropped
+const MAX_DOMAIN_LENGTH = 253
+
+// Expands the macros of a domain-spec for the check_host() call evaluating
+// the record published at domain
+func (e *evaluator) expand(spec, domain string) (string, error) {
+	var expandErr error
+	expanded := macroRe.ReplaceAllStringFunc(spec, func(macro string) string {
+		switch macro {
+		case "%%":
+			return "%"
+		case "%_":
+			return " "
+		case "%-":
+			return "%20"
+		}
+		m := macroRe.FindStringSubmatch(macro)
+		value, err := e.macroValue(strings.ToLower(m[1]), domain)
+		if err != nil {
+			expandErr = err
+			return ""
+		}
+		value = transform(value, m[2], m[3] != "", m[4])
+		if strings.ToUpper(m[1]) == m[1] {
+			// Uppercase macro letters are URL escaped
+			value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	for len(expanded) > MAX_DOMAIN_LENGTH {
+		i := strings.Index(expanded, ".")
+		if i < 0 {
+			break
+		}
+		expanded = expanded[i+1:]
+	}
+	return expanded, nil
+}
+
+func (e *evaluator) macroValue(letter, domain string) (string, error) {
+	local, senderDomain := e.senderParts()
+	switch letter {
+	case "s":
+		return local + "@" + senderDomain, nil
+	case "l":
+		return local, nil
+	case "o":
+		return senderDomain, nil
+	case "d":
+		return domain, nil
+	case "i":
+		return dottedIP(e.ip), nil
+	case "p":
+		return e.validatedName(domain), nil
+	case "v":
+		if e.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case "h":
+		return e.helo, nil
+	}
+	return "", errors.New("Macro letter " + letter + " is not allowed in a domain-spec")
+}
+
+// The local part and domain of the sender, with the RFC 7208 defaults
+func (e *evaluator) senderParts() (string, string) {
+	sender := e.sender
+	if sender == "" {
+		sender = "postmaster@" + e.helo
+	}
+	i := strings.LastIndex(sender, "@")
+	if i < 0 {
+		return "postmaster", sender
+	}
+	local := sender[:i]
+	if local == "" {
+		local = "postmaster"
+	}
+	return local, sender[i+1:]
+}
+
+// IPv4 addresses are dotted quads, IPv6 addresses dotted nibbles
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := []string{}
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Splits on the delimiters, reverses and keeps the rightmost parts as asked,
+// then joins with dots
+func transform(value, digits string, reverse bool, delimiters string) string {
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep, err := strconv.Atoi(digits); err == nil && keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,244 @@
+package spf
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The network an ip4 or ip6 mechanism matches, with the host bits zeroed
+func parseNetwork(term Term) (*net.IPNet, error) {
+	value := term.Value
+	bits := 128
+	if term.Kind == KindIP4 {
+		bits = 32
+	}
+	if !strings.Contains(value, "/") {
+		value += "/" + strconv.Itoa(bits)
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, size := network.Mask.Size(); size != bits {
+		return nil, errors.New("Wrong address family for " + term.String())
+	}
+	return network, nil
+}
+
+// How networks are written in mechanisms, leaving out the length of single
+// addresses
+func networkValue(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+func networkTerm(q Qualifier, network *net.IPNet) Term {
+	kind := KindIP6
+	if _, bits := network.Mask.Size(); bits == 32 {
+		kind = KindIP4
+	}
+	return NewTerm(q, kind, networkValue(network))
+}
+
+// Every IPv4 and IPv6 address, which is what all matches
+func universe() []*net.IPNet {
+	return []*net.IPNet{
+		&net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		&net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+	}
+}
+
+// Whether a contains all of b. Two networks either nest or are disjoint.
+func covers(a, b *net.IPNet) bool {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	return aBits == bBits && aOnes <= bOnes && a.Contains(b.IP)
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return covers(a, b) || covers(b, a)
+}
+
+// The two halves of a network one bit longer
+func halves(network *net.IPNet) (*net.IPNet, *net.IPNet) {
+	ones, bits := network.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+	low := &net.IPNet{IP: network.IP, Mask: mask}
+	high := &net.IPNet{IP: make(net.IP, len(network.IP)), Mask: mask}
+	copy(high.IP, network.IP)
+	high.IP[ones/8] |= 0x80 >> uint(ones%8)
+	return low, high
+}
+
+// The parts of a network that are not in any of the others, as the fewest
+// networks possible
+func subtract(network *net.IPNet, others []*net.IPNet) []*net.IPNet {
+	for _, other := range others {
+		if covers(other, network) {
+			return []*net.IPNet{}
+		}
+	}
+	for _, other := range others {
+		if covers(network, other) {
+			// Only part of it is taken, so try again on each half
+			low, high := halves(network)
+			return append(subtract(low, others), subtract(high, others)...)
+		}
+	}
+	return []*net.IPNet{network}
+}
+
+// Walks the ip4, ip6 and all mechanisms of a flattened record in order,
+// calling fn with each network and the parts of it that no earlier mechanism
+// matched. Returns everything the record matches.
+func (spf *SPF) walkNetworks(fn func(term Term, network *net.IPNet, remaining []*net.IPNet)) ([]*net.IPNet, error) {
+	matched := []*net.IPNet{}
+	for _, term := range spf.Terms {
+		var networks []*net.IPNet
+		switch {
+		case term.Kind == KindIP4 || term.Kind == KindIP6:
+			network, err := parseNetwork(term)
+			if err != nil {
+				return nil, err
+			}
+			networks = []*net.IPNet{network}
+		case term.Kind == KindAll:
+			networks = universe()
+		case term.Kind.IsMechanism():
+			return nil, errors.New("Cannot flatten " + term.String() + " from " + spf.Domain)
+		default:
+			continue
+		}
+
+		for _, network := range networks {
+			fn(term, network, subtract(network, matched))
+		}
+		matched = append(matched, networks...)
+		if term.Kind == KindAll {
+			break
+		}
+	}
+	return matched, nil
+}
+
+// Rewrites the ip4 and ip6 mechanisms of a flattened record as the fewest
+// networks that give every address the same result. Host bits are zeroed,
+// networks an earlier mechanism already matched are dropped and each run of
+// mechanisms sharing a qualifier is merged into supernets where possible.
+func (spf *SPF) Normalize() error {
+	terms := []Term{}
+	matched := []*net.IPNet{}
+	var run []*net.IPNet
+	var runQualifier Qualifier
+	flush := func() {
+		for _, network := range aggregate(run) {
+			terms = append(terms, networkTerm(runQualifier, network))
+		}
+		run = nil
+	}
+
+	for i, term := range spf.Terms {
+		if term.Kind != KindIP4 && term.Kind != KindIP6 {
+			flush()
+			terms = append(terms, term)
+			if term.Kind == KindAll {
+				// Nothing after all ever matches
+				for _, rest := range spf.Terms[i+1:] {
+					if !rest.Kind.IsMechanism() {
+						terms = append(terms, rest)
+					}
+				}
+				break
+			}
+			continue
+		}
+		network, err := parseNetwork(term)
+		if err != nil {
+			return err
+		}
+		if len(subtract(network, matched)) == 0 {
+			// Whatever matched it first decides
+			continue
+		}
+		if term.Qualifier != runQualifier {
+			flush()
+			runQualifier = term.Qualifier
+		}
+		run = append(run, network)
+		matched = append(matched, network)
+	}
+	flush()
+	spf.Terms = terms
+	return nil
+}
+
+// The fewest networks covering exactly the same addresses, sorted by address
+func aggregate(networks []*net.IPNet) []*net.IPNet {
+	sorted := make([]*net.IPNet, len(networks))
+	copy(sorted, networks)
+	sort.Sort(byNetwork(sorted))
+
+	merged := []*net.IPNet{}
+	for _, network := range sorted {
+		if len(merged) > 0 && covers(merged[len(merged)-1], network) {
+			continue
+		}
+		merged = append(merged, network)
+		// Two halves of the same network make the whole one, which may in
+		// turn complete its own parent
+		for len(merged) > 1 {
+			low, high := merged[len(merged)-2], merged[len(merged)-1]
+			parent, ok := siblingsParent(low, high)
+			if !ok {
+				break
+			}
+			merged = append(merged[:len(merged)-2], parent)
+		}
+	}
+	return merged
+}
+
+// The network low and high are the two halves of, if they are
+func siblingsParent(low, high *net.IPNet) (*net.IPNet, bool) {
+	lowOnes, lowBits := low.Mask.Size()
+	highOnes, highBits := high.Mask.Size()
+	if lowBits != highBits || lowOnes != highOnes || lowOnes == 0 {
+		return nil, false
+	}
+	mask := net.CIDRMask(lowOnes-1, lowBits)
+	parent := &net.IPNet{IP: low.IP.Mask(mask), Mask: mask}
+	if !parent.IP.Equal(low.IP) {
+		return nil, false
+	}
+	_, upper := halves(parent)
+	if !upper.IP.Equal(high.IP) {
+		return nil, false
+	}
+	return parent, true
+}
+
+// IPv4 first, then by address, with larger networks before the ones they
+// contain
+type byNetwork []*net.IPNet
+
+func (a byNetwork) Len() int      { return len(a) }
+func (a byNetwork) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byNetwork) Less(i, j int) bool {
+	x, y := a[i].IP, a[j].IP
+	if len(x) != len(y) {
+		return len(x) < len(y)
+	}
+	if c := bytes.Compare(x, y); c != 0 {
+		return c < 0
+	}
+	xOnes, _ := a[i].Mask.Size()
+	yOnes, _ := a[j].Mask.Size()
+	return xOnes < yOnes
+}
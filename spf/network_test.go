@@ -0,0 +1,45 @@
+package spf
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		txt      string
+		expected string
+	}{
+		// Host bits are zeroed
+		{"v=spf1 ip4:10.0.0.7/24 ip6:2001:db8::1/32 -all", "v=spf1 ip4:10.0.0.0/24 ip6:2001:db8::/32 -all"},
+		// Covered networks are dropped, adjacent siblings merged
+		{"v=spf1 ip4:10.0.0.0/24 ip4:10.0.1.0/24 ip4:10.0.0.5 ip4:10.0.2.0/23 ~all", "v=spf1 ip4:10.0.0.0/22 ~all"},
+		{"v=spf1 ip4:192.0.2.0 ip4:192.0.2.1 ip4:192.0.2.2/31 ip4:198.51.100.0/24 -all", "v=spf1 ip4:192.0.2.0/30 ip4:198.51.100.0/24 -all"},
+		{"v=spf1 ip6:2001:db8::/33 ip6:2001:db8:8000::/33 ip6:2001:db8:1::1 -all", "v=spf1 ip6:2001:db8::/32 -all"},
+		// Not siblings, so nothing to merge
+		{"v=spf1 ip4:10.0.1.0/24 ip4:10.0.2.0/24 -all", "v=spf1 ip4:10.0.1.0/24 ip4:10.0.2.0/24 -all"},
+		// Runs with different qualifiers stay apart and in order
+		{"v=spf1 -ip4:10.0.0.1 ip4:10.0.0.0/25 ip4:10.0.0.128/25 ?ip4:10.0.0.4 exp=explain._spf.%{d}", "v=spf1 -ip4:10.0.0.1 ip4:10.0.0.0/24 exp=explain._spf.%{d}"},
+		{"v=spf1 ip4:10.0.0.0/24 -ip4:10.0.1.0/24 ip4:10.0.2.0/24 ~all", "v=spf1 ip4:10.0.0.0/24 -ip4:10.0.1.0/24 ip4:10.0.2.0/24 ~all"},
+		// Nothing matches after all
+		{"v=spf1 ip4:10.0.0.0/8 ~all ip4:192.0.2.0/24 redirect=_spf.example.com", "v=spf1 ip4:10.0.0.0/8 ~all redirect=_spf.example.com"},
+	}
+	for _, test := range tests {
+		rec := mustParse(t, test.txt)
+		if err := rec.Normalize(); err != nil {
+			t.Errorf("Error normalizing %s: %s", test.txt, err)
+			continue
+		}
+		if rec.AsTXTRecord() != test.expected {
+			t.Errorf("Normalize of %s = %s, expected %s", test.txt, rec.AsTXTRecord(), test.expected)
+		}
+		original := mustParse(t, test.txt)
+		if diffs, err := Diff(original, rec); err != nil || len(diffs) > 0 {
+			t.Errorf("Normalize of %s changed results: %v %v", test.txt, diffs, err)
+		}
+	}
+
+	rec := mustParse(t, "v=spf1 include:_spf.example.com ip4:10.0.0.0/24 -all")
+	if err := rec.Normalize(); err != nil {
+		t.Errorf("Normalize should leave other mechanisms alone: %s", err)
+	}
+}
@@ -0,0 +1,114 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Makes the DNS queries of one Flatten call. At most concurrency queries
+// are in flight at once, and asking for something that was or is being
+// queried already waits for that answer instead of querying again.
+type resolver struct {
+	ctx         context.Context
+	querent     TXTQuerent
+	concurrency int
+	maxQueries  int
+	slots       chan struct{}
+
+	mu      sync.Mutex
+	queries int
+	calls   map[string]*call
+}
+
+// One query, shared by everyone asking for the same thing
+type call struct {
+	done  chan struct{}
+	txts  []string
+	ips   []net.IP
+	hosts []string
+	ttl   time.Duration
+	err   error
+}
+
+func newResolver(ctx context.Context, querent TXTQuerent, concurrency, maxQueries int) *resolver {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &resolver{
+		ctx:         ctx,
+		querent:     querent,
+		concurrency: concurrency,
+		maxQueries:  maxQueries,
+		slots:       make(chan struct{}, concurrency),
+		calls:       map[string]*call{},
+	}
+}
+
+// Runs fn on its own goroutine, or right away when queries are made one at
+// a time so the order they are made in stays the same
+func (r *resolver) spawn(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	if r.concurrency == 1 {
+		fn()
+		wg.Done()
+		return
+	}
+	go func() {
+		defer wg.Done()
+		fn()
+	}()
+}
+
+// Returns the call for a query, making it if nobody has yet. Only queries
+// that are actually made count against the budget.
+func (r *resolver) do(key, name string, query func(c *call)) *call {
+	r.mu.Lock()
+	if c, ok := r.calls[key]; ok {
+		r.mu.Unlock()
+		<-c.done
+		return c
+	}
+	c := &call{done: make(chan struct{})}
+	r.calls[key] = c
+	r.queries++
+	overBudget := r.maxQueries > 0 && r.queries > r.maxQueries
+	r.mu.Unlock()
+
+	if overBudget {
+		c.err = &QueryBudgetError{Name: name, MaxQueries: r.maxQueries}
+	} else if err := r.ctx.Err(); err != nil {
+		// Out of time, no point in starting another query
+		c.err = err
+	} else {
+		r.slots <- struct{}{}
+		query(c)
+		<-r.slots
+	}
+	close(c.done)
+	return c
+}
+
+// Along with the answers, each returns their TTL if the querent knows it
+
+func (r *resolver) txt(name string) ([]string, time.Duration, error) {
+	c := r.do("TXT "+name, name, func(c *call) {
+		c.txts, c.ttl, c.err = queryTTL(r.ctx, r.querent, name)
+	})
+	return c.txts, c.ttl, c.err
+}
+
+func (r *resolver) ip(name string) ([]net.IP, time.Duration, error) {
+	c := r.do("IP "+name, name, func(c *call) {
+		c.ips, c.ttl, c.err = queryIPTTL(r.ctx, r.querent, name)
+	})
+	return c.ips, c.ttl, c.err
+}
+
+func (r *resolver) mx(name string) ([]string, time.Duration, error) {
+	c := r.do("MX "+name, name, func(c *call) {
+		c.hosts, c.ttl, c.err = queryMXTTL(r.ctx, r.querent, name)
+	})
+	return c.hosts, c.ttl, c.err
+}
@@ -0,0 +1,105 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Answers from a map, slowly, keeping track of how it's queried
+type slowQuerent struct {
+	txts map[string][]string
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	counts      map[string]int
+}
+
+func (q *slowQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	q.mu.Lock()
+	q.counts[name]++
+	q.inFlight++
+	if q.inFlight > q.maxInFlight {
+		q.maxInFlight = q.inFlight
+	}
+	q.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	q.mu.Lock()
+	q.inFlight--
+	q.mu.Unlock()
+	txts, ok := q.txts[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func (q *slowQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (q *slowQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	return nil, nil
+}
+
+func (q *slowQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	return nil, nil
+}
+
+func TestFlattenConcurrently(t *testing.T) {
+	newQuerent := func() *slowQuerent {
+		q := &slowQuerent{
+			txts: map[string][]string{
+				"_spf.common.com": []string{"v=spf1 ip4:203.0.113.0/24 -all"},
+			},
+			counts: map[string]int{},
+		}
+		for i := 0; i < 8; i++ {
+			q.txts[fmt.Sprintf("_spf.vendor%d.com", i)] = []string{
+				fmt.Sprintf("v=spf1 ip4:10.%d.0.0/16 include:_spf.common.com -all", i),
+			}
+		}
+		return q
+	}
+	txt := "v=spf1"
+	for i := 0; i < 8; i++ {
+		txt += fmt.Sprintf(" include:_spf.vendor%d.com", i)
+	}
+	txt += " ~all"
+
+	sequential := mustParse(t, txt)
+	sequential.Querent = newQuerent()
+	expected, err := sequential.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+
+	querent := newQuerent()
+	r1 := mustParse(t, txt)
+	r1.Querent = querent
+	r1.Concurrency = 3
+	for run := 0; run < 3; run++ {
+		querent.counts = map[string]int{}
+		flat, err := r1.Flatten(context.Background())
+		if err != nil {
+			t.Fatalf("Error during flatten: %s", err)
+		}
+		if flat.AsTXTRecord() != expected.AsTXTRecord() {
+			t.Errorf("Output should not depend on timing: %s", flat.AsTXTRecord())
+		}
+		for name, count := range querent.counts {
+			if count != 1 {
+				t.Errorf("%s queried %d times", name, count)
+			}
+		}
+	}
+	if querent.maxInFlight > 3 || querent.maxInFlight < 2 {
+		t.Errorf("Wrong number of queries at once: %d", querent.maxInFlight)
+	}
+}
@@ -0,0 +1,158 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Gives every query a timeout of its own and retries those that fail
+// temporarily, waiting longer before each retry. Names that don't exist are
+// never retried. The context of the caller still bounds the whole query,
+// retries included.
+type RetryQuerent struct {
+	Querent TXTQuerent
+	// How long one attempt may take, 0 for as long as the context allows
+	Timeout time.Duration
+	// Attempts after the first one
+	Retries int
+	// Wait before the first retry, doubled for each one after that
+	Backoff time.Duration
+}
+
+func NewRetryQuerent(querent TXTQuerent) *RetryQuerent {
+	return &RetryQuerent{
+		Querent: querent,
+		Timeout: 2 * time.Second,
+		Retries: 2,
+		Backoff: 200 * time.Millisecond,
+	}
+}
+
+func (q *RetryQuerent) Unwrap() TXTQuerent {
+	return q.Querent
+}
+
+// Returns a *TempError when the query never got a definite answer, and
+// context.Canceled as it is when the caller gave up on it
+func (q *RetryQuerent) retry(ctx context.Context, name string, query func(context.Context) error) error {
+	backoff := q.Backoff
+	var err error
+	attempts := 0
+	for attempts <= q.Retries {
+		if attempts > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				if ctx.Err() == context.Canceled {
+					return ctx.Err()
+				}
+				return &TempError{Name: name, Attempts: attempts, Err: ctx.Err()}
+			}
+			backoff *= 2
+		}
+		attempts++
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if q.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, q.Timeout)
+		}
+		err = query(attemptCtx)
+		timedOut := attemptCtx.Err() != nil
+		cancel()
+		if err != nil && ctx.Err() == context.Canceled {
+			return ctx.Err()
+		}
+		if err == nil || (!IsTemporary(err) && !timedOut) {
+			return err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return &TempError{Name: name, Attempts: attempts, Err: err}
+}
+
+func (q *RetryQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	var txts []string
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		txts, err = q.Querent.Query(ctx, name)
+		return err
+	})
+	return txts, err
+}
+
+func (q *RetryQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	var ips []net.IP
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		ips, err = q.Querent.QueryIP(ctx, name)
+		return err
+	})
+	return ips, err
+}
+
+func (q *RetryQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	var hosts []string
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		hosts, err = q.Querent.QueryMX(ctx, name)
+		return err
+	})
+	return hosts, err
+}
+
+func (q *RetryQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	var names []string
+	err := q.retry(ctx, addr, func(ctx context.Context) (err error) {
+		names, err = q.Querent.QueryPTR(ctx, addr)
+		return err
+	})
+	return names, err
+}
+
+func (q *RetryQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	var txts []string
+	var ttl time.Duration
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		txts, ttl, err = queryTTL(ctx, q.Querent, name)
+		return err
+	})
+	return txts, ttl, err
+}
+
+func (q *RetryQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl time.Duration
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		ips, ttl, err = queryIPTTL(ctx, q.Querent, name)
+		return err
+	})
+	return ips, ttl, err
+}
+
+func (q *RetryQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	var hosts []string
+	var ttl time.Duration
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		hosts, ttl, err = queryMXTTL(ctx, q.Querent, name)
+		return err
+	})
+	return hosts, ttl, err
+}
+
+// Asks the querent's authoritative nameservers, when it can
+func (q *RetryQuerent) QueryAuthoritiesTTL(ctx context.Context, name string) (map[string][]string, time.Duration, error) {
+	authorities, ok := q.Querent.(interface {
+		QueryAuthoritiesTTL(context.Context, string) (map[string][]string, time.Duration, error)
+	})
+	if !ok {
+		return nil, 0, fmt.Errorf("%T cannot ask authoritative nameservers", q.Querent)
+	}
+	var byServer map[string][]string
+	var ttl time.Duration
+	err := q.retry(ctx, name, func(ctx context.Context) (err error) {
+		byServer, ttl, err = authorities.QueryAuthoritiesTTL(ctx, name)
+		return err
+	})
+	return byServer, ttl, err
+}
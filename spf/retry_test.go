@@ -0,0 +1,141 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Fails temporarily a number of times before answering, or hangs until the
+// context is done
+type flakyQuerent struct {
+	failures int
+	hang     bool
+	attempts int
+}
+
+func (q *flakyQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	q.attempts++
+	if q.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if q.attempts <= q.failures {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if name == "missing.example.com" {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return []string{"v=spf1 -all"}, nil
+}
+
+func (q *flakyQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	return nil, nil
+}
+
+func (q *flakyQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	return nil, nil
+}
+
+func (q *flakyQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	return nil, nil
+}
+
+func TestRetryQuerent(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyQuerent{failures: 2}
+	querent := NewRetryQuerent(flaky)
+	querent.Backoff = time.Millisecond
+	if _, err := querent.Query(ctx, "example.com"); err != nil || flaky.attempts != 3 {
+		t.Errorf("Should succeed on the third attempt: %v after %d", err, flaky.attempts)
+	}
+
+	flaky = &flakyQuerent{failures: 5}
+	querent.Querent = flaky
+	_, err := querent.Query(ctx, "example.com")
+	if tempErr, ok := err.(*TempError); !ok || tempErr.Attempts != 3 || !IsTemporary(err) {
+		t.Errorf("Expected a *TempError after 3 attempts, got %v", err)
+	}
+
+	// Names that don't exist won't start existing
+	flaky = &flakyQuerent{}
+	querent.Querent = flaky
+	_, err = querent.Query(ctx, "missing.example.com")
+	if !IsNotFound(err) || IsTemporary(err) || flaky.attempts != 1 {
+		t.Errorf("Expected a single not found error, got %v after %d", err, flaky.attempts)
+	}
+
+	// Each attempt times out on its own
+	flaky = &flakyQuerent{hang: true}
+	querent.Querent = flaky
+	querent.Timeout = 5 * time.Millisecond
+	_, err = querent.Query(ctx, "example.com")
+	if !IsTemporary(err) || flaky.attempts != 3 {
+		t.Errorf("Expected a temporary error after 3 timeouts, got %v after %d", err, flaky.attempts)
+	}
+
+	// The caller's deadline bounds everything
+	querent.Timeout = time.Minute
+	querent.Retries = 100
+	deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = querent.Query(deadline, "example.com")
+	if !IsTemporary(err) || time.Since(start) > time.Second {
+		t.Errorf("Expected to give up at the deadline, got %v after %s", err, time.Since(start))
+	}
+	if !IsTemporary(fmt.Errorf("Querying example.com: %w", context.DeadlineExceeded)) {
+		t.Error("Wrapped deadlines should be temporary")
+	}
+
+	// Nothing is retried once the caller gives up
+	flaky = &flakyQuerent{hang: true}
+	querent.Querent = flaky
+	canceled, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = querent.Query(canceled, "example.com")
+	if err != context.Canceled || flaky.attempts != 1 {
+		t.Errorf("Expected to stop when canceled, got %v after %d", err, flaky.attempts)
+	}
+}
+
+// Asks authoritative nameservers, failing temporarily like flakyQuerent
+type flakyAuthorities struct {
+	flakyQuerent
+}
+
+func (q *flakyAuthorities) QueryAuthoritiesTTL(ctx context.Context, name string) (map[string][]string, time.Duration, error) {
+	txts, err := q.Query(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return map[string][]string{"192.0.2.1:53": txts}, time.Hour, nil
+}
+
+func TestRetryQuerentAuthorities(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyAuthorities{flakyQuerent{failures: 1}}
+	querent := NewRetryQuerent(flaky)
+	querent.Backoff = time.Millisecond
+	byServer, ttl, err := querent.QueryAuthoritiesTTL(ctx, "_spf.example.com")
+	if err != nil || len(byServer) != 1 || ttl != time.Hour || flaky.attempts != 2 {
+		t.Errorf("Should retry asking the nameservers: %v %s %v after %d attempts", byServer, ttl, err, flaky.attempts)
+	}
+
+	if _, _, err := NewRetryQuerent(&flakyQuerent{}).QueryAuthoritiesTTL(ctx, "_spf.example.com"); err == nil {
+		t.Error("Should fail for querents that can't ask authoritative nameservers")
+	}
+}
+
+func TestFlattenDeadline(t *testing.T) {
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com include:_spf.other.com -all")
+	r1.Querent = &flakyQuerent{hang: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := r1.Flatten(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to stop Flatten, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package spf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-3.4
+// A DNS response over plain UDP is limited to 512 octets (RFC 1035 section
+// 4.2.1). Resolvers that use EDNS0 advertise a larger payload size.
+const UDP_RESPONSE_SIZE = 512
+
+// A single TXT character-string holds at most this many octets
+const MAX_TXT_STRING = 255
+
+// What else ends up in the DNS response carrying a record
+type ResponseBudget struct {
+	// Owner name of the record. Only its length matters, so splits can be
+	// measured before their names are known.
+	Name string
+	// Other TXT records at the same name, which are returned along with it
+	OtherTXT []string
+	// The largest response allowed, UDP_RESPONSE_SIZE unless EDNS0 is used
+	Size int
+}
+
+func NewResponseBudget(name string) *ResponseBudget {
+	return &ResponseBudget{
+		Name:     name,
+		OtherTXT: []string{},
+		Size:     UDP_RESPONSE_SIZE,
+	}
+}
+
+// Octets of a domain name on the wire, uncompressed
+func nameLength(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 1
+	}
+	// A length octet per label plus the root label
+	return len(name) + 2
+}
+
+// Octets of the RDATA of a TXT record, split into character-strings the
+// way TXTStrings does it, each with a length octet
+func txtDataLength(length int) int {
+	count := (length + MAX_TXT_STRING - 1) / MAX_TXT_STRING
+	if count == 0 {
+		count = 1
+	}
+	return length + count
+}
+
+// Octets of the answer to a TXT query for Name, if it had a record of the
+// given length next to the other TXT records
+func (b *ResponseBudget) responseSize(length int) int {
+	// Header, then the question: name, type and class
+	size := 12 + nameLength(b.Name) + 4
+	// Answers point back at the question's name, then carry type, class, TTL
+	// and RDATA length
+	const answer = 2 + 10
+	size += answer + txtDataLength(length)
+	for _, txt := range b.OtherTXT {
+		size += answer + txtDataLength(len(txt))
+	}
+	if b.Size > UDP_RESPONSE_SIZE {
+		// The OPT pseudo-record of EDNS0 goes in the additional section
+		size += 11
+	}
+	return size
+}
+
+// Octets of the DNS response that would carry txt
+func (b *ResponseBudget) ResponseSize(txt string) int {
+	return b.responseSize(len(txt))
+}
+
+func (b *ResponseBudget) Fits(txt string) bool {
+	return b.ResponseSize(txt) <= b.Size
+}
+
+// Packs the mechanisms of a run into as few subrecords as fit, largest
+// first. Each subrecord keeps its mechanisms in their original order.
+func (b *ResponseBudget) pack(run []Term) ([][]Term, error) {
+	// "v=spf1" and " -all", as Subrecord publishes it
+	const base = 6 + 5
+
+	type bin struct {
+		length  int
+		indexes []int
+	}
+	lengths := make([]int, len(run))
+	order := make([]int, len(run))
+	for i, term := range run {
+		term.Qualifier = QualifierPass
+		lengths[i] = 1 + len(term.String())
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return lengths[order[i]] > lengths[order[j]]
+	})
+
+	bins := []*bin{}
+	for _, i := range order {
+		var fit *bin
+		for _, candidate := range bins {
+			if b.responseSize(candidate.length+lengths[i]) <= b.Size {
+				fit = candidate
+				break
+			}
+		}
+		if fit == nil {
+			if b.responseSize(base+lengths[i]) > b.Size {
+				return nil, fmt.Errorf("%s does not fit in a %d octet response for %s", run[i], b.Size, b.Name)
+			}
+			fit = &bin{length: base}
+			bins = append(bins, fit)
+		}
+		fit.length += lengths[i]
+		fit.indexes = append(fit.indexes, i)
+	}
+
+	packed := [][]Term{}
+	for _, bin := range bins {
+		sort.Ints(bin.indexes)
+		terms := []Term{}
+		for _, i := range bin.indexes {
+			terms = append(terms, run[i])
+		}
+		packed = append(packed, terms)
+	}
+	return packed, nil
+}
@@ -1,48 +1,104 @@
 package spf
 
 import (
+	"context"
 	"errors"
-	"math"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+// Receivers give up after 10 lookups, so records nested deeper than that
+// are broken anyway
+const DEFAULT_MAX_DEPTH = 10
+
+// Enough for a dozen vendors with a few levels of includes each
+const DEFAULT_MAX_QUERIES = 250
+
+// What Flatten does when an upstream record fails to parse
+type ParseErrorPolicy int
+
+const (
+	// Abort, like receivers that treat the include as a permerror
+	ParseErrorFail ParseErrorPolicy = iota
+	// Leave the record out as if it was never published, with a warning
+	ParseErrorSkip
+)
+
+// What Flatten does when a name has more than one SPF record, which
+// receivers treat as a permerror (RFC 7208 section 4.5)
+type MultipleRecordsPolicy int
+
+const (
+	// Abort with a *MultipleRecordsError
+	MultipleRecordsFail MultipleRecordsPolicy = iota
+	// Flatten all of them together, with a warning
+	MultipleRecordsWarn
+	// Flatten only the one that sorts first, with a warning. The order of
+	// the answers changes from query to query, sorting doesn't.
+	MultipleRecordsPick
 )
 
-// http://www.openspf.org/RFC_4408#rsize
-// A TXT response should never exceed 512 bytes. This includes the domain name
-// and any other TXT records returned in the same response.
-// A standard record looks like:
-// v=spf1 ip4:123.123.123.123/12 ip6:1234:1234:1234::12 -all
-// [--7--][---------23----------][---------23----------][-4]
-// Therefore, to guarantee we don't exceed 450 octets:
-// 450 >= 7 + 23*ips + 4
-//  19 >= ips
-const MAX_CIDRS = 19
-
-// A, Mx, Ptr mechanisms not supported
 type SPF struct {
-	V           string
-	Ip4         []string
-	Ip6         []string
-	Include     []string
-	AllRune     byte
-	Querent     TXTQuerent
+	V                     string
+	Domain                string // where the record is published
+	Terms                 []Term
+	Querent               TXTQuerent
+	ParseErrorPolicy      ParseErrorPolicy
+	MultipleRecordsPolicy MultipleRecordsPolicy
+	// How deep Flatten follows includes and redirects, 0 for no limit
+	MaxDepth int
+	// How many DNS queries one Flatten or CountLookups may make, 0 for no
+	// limit
+	MaxQueries int
+	// How many DNS queries Flatten makes at once. With 1, the default, they
+	// are made one at a time in record order.
+	Concurrency int
+	// Lookups Flatten made, see CountLookups for what receivers make
 	LookupCount int
+	// Problems Flatten worked around rather than failing on
+	Warnings []string
+	// The lowest TTL of the DNS answers Flatten used, 0 when not known.
+	// Published results should not be cached for longer.
+	TTL time.Duration
 }
 
 func NewSPF() *SPF {
 	return &SPF{
-		V:           "spf1",
-		Ip4:         []string{},
-		Ip6:         []string{},
-		Include:     []string{},
-		AllRune:     '?', // least restrictive
-		Querent:     SimpleTXTQuerent{},
-		LookupCount: 0,
+		V:                "spf1",
+		Terms:            []Term{},
+		Querent:          SimpleTXTQuerent{},
+		ParseErrorPolicy: ParseErrorFail,
+		MaxDepth:         DEFAULT_MAX_DEPTH,
+		MaxQueries:       DEFAULT_MAX_QUERIES,
+		Concurrency:      1,
+		LookupCount:      0,
+		Warnings:         []string{},
 	}
 }
 
-func (spf *SPF) Clone() *SPF {
+// A new empty record that resolves the same way this one does
+func (spf *SPF) child() *SPF {
 	rec := NewSPF()
-	return rec.Append(spf)
+	rec.Querent = spf.Querent
+	rec.ParseErrorPolicy = spf.ParseErrorPolicy
+	rec.MultipleRecordsPolicy = spf.MultipleRecordsPolicy
+	rec.MaxDepth = spf.MaxDepth
+	rec.MaxQueries = spf.MaxQueries
+	rec.Concurrency = spf.Concurrency
+	return rec
+}
+
+func (spf *SPF) Clone() *SPF {
+	rec := *spf
+	rec.Terms = make([]Term, len(spf.Terms))
+	copy(rec.Terms, spf.Terms)
+	rec.Warnings = make([]string, len(spf.Warnings))
+	copy(rec.Warnings, spf.Warnings)
+	return &rec
 }
 
 func strInSlice(s string, a []string) bool {
@@ -54,153 +110,513 @@ func strInSlice(s string, a []string) bool {
 	return false
 }
 
-func (s *SPF) Append(spfs ...*SPF) *SPF {
-	for _, spf := range spfs {
-		for _, ip4 := range spf.Ip4 {
-			// dedup while appending
-			if !strInSlice(ip4, s.Ip4) {
-				s.Ip4 = append(s.Ip4, ip4)
-			}
+func termInSlice(t Term, a []Term) bool {
+	for _, e := range a {
+		if e == t {
+			return true
 		}
-		for _, ip6 := range spf.Ip6 {
-			// dedup while appending
-			if !strInSlice(ip6, s.Ip6) {
-				s.Ip6 = append(s.Ip6, ip6)
-			}
+	}
+	return false
+}
+
+// The values of every term of the given kind, in record order
+func (spf *SPF) Values(kind Kind) []string {
+	values := []string{}
+	for _, term := range spf.Terms {
+		if term.Kind == kind {
+			values = append(values, term.Value)
+		}
+	}
+	return values
+}
+
+// The qualifier of the all mechanism, if there is one
+func (spf *SPF) All() (Qualifier, bool) {
+	for _, term := range spf.Terms {
+		if term.Kind == KindAll {
+			return term.Qualifier, true
+		}
+	}
+	return 0, false
+}
+
+// Replaces any all mechanism with one using the given qualifier, placed
+// last among the mechanisms
+func (spf *SPF) SetAll(q Qualifier) {
+	terms := []Term{}
+	modifiers := []Term{}
+	for _, term := range spf.Terms {
+		switch {
+		case term.Kind == KindAll:
+		case term.Kind.IsMechanism():
+			terms = append(terms, term)
+		default:
+			modifiers = append(modifiers, term)
 		}
-		s.Include = append(s.Include, spf.Include...)
-		if s.AllRune != spf.AllRune {
-			if s.AllRune == '-' || spf.AllRune == '-' {
-				// most restrictive
-				s.AllRune = '-'
-			} else {
-				s.AllRune = '~'
+	}
+	terms = append(terms, NewTerm(q, KindAll, ""))
+	spf.Terms = append(terms, modifiers...)
+}
+
+// Appends the mechanisms of other records, in order and with their
+// qualifiers, before this record's all. The all mechanisms and modifiers of
+// the other records are not carried over.
+func (s *SPF) Append(spfs ...*SPF) *SPF {
+	for _, spf := range spfs {
+		for _, term := range spf.Terms {
+			if term.Kind.IsMechanism() && term.Kind != KindAll {
+				s.addMechanism(term)
 			}
 		}
 	}
 	return s
 }
 
-// If the IP CIDRs won't fit into one record, the client (of this package)
-// has to deal with splitting them across different requests. But we can
-// help by returning multiple SPF records that do fit.
-func (s *SPF) Split() ([]*SPF, error) {
-	if len(s.Include) > 0 {
-		return nil, errors.New("Record cannot have includes when splitting")
+// Adds a mechanism after the existing ones, but before any all. Duplicates
+// are left out.
+func (spf *SPF) addMechanism(term Term) {
+	if termInSlice(term, spf.Terms) {
+		return
+	}
+	i := 0
+	for i < len(spf.Terms) && spf.Terms[i].Kind.IsMechanism() && spf.Terms[i].Kind != KindAll {
+		i++
 	}
-	// Don't want to modify the original input
-	spf := s.Clone()
+	spf.Terms = append(spf.Terms, Term{})
+	copy(spf.Terms[i+1:], spf.Terms[i:])
+	spf.Terms[i] = term
+}
 
-	numRecords := int(math.Ceil(float64(len(spf.Ip4)+len(spf.Ip6)) / MAX_CIDRS))
-	if numRecords == 1 {
-		// Record is small enough, just return it!
-		return []*SPF{spf}, nil
+// If the IP CIDRs won't fit into one record, the client (of this package)
+// has to deal with splitting them across different requests. But we can
+// help by returning multiple SPF records that do fit in a DNS response
+// within the budget, as few as possible. Each one only has mechanisms with
+// the same qualifier, so it can be published as a Subrecord, and none of
+// them has an all: that stays in the record that includes them.
+func (s *SPF) Split(budget *ResponseBudget) ([]*SPF, error) {
+	cidrs := []Term{}
+	for _, term := range s.Terms {
+		switch term.Kind {
+		case KindIP4, KindIP6:
+			cidrs = append(cidrs, term)
+		case KindAll, KindExp, KindUnknown:
+		default:
+			return nil, errors.New("Record cannot have includes or other lookups when splitting")
+		}
 	}
 
 	records := []*SPF{}
-	for i := 0; i < numRecords; i++ {
-		space := MAX_CIDRS
-		rec := NewSPF()
-
-		fours := int(math.Min(float64(space), float64(len(spf.Ip4))))
-		rec.Ip4 = spf.Ip4[0:fours]
-		space -= fours
-		spf.Ip4 = spf.Ip4[fours:]
-
-		sixes := int(math.Min(float64(space), float64(len(spf.Ip6))))
-		rec.Ip6 = spf.Ip6[0:sixes]
-		space -= sixes
-		spf.Ip6 = spf.Ip6[sixes:]
-
-		rec.AllRune = spf.AllRune
+	for len(cidrs) > 0 {
+		// Take a run of mechanisms that share a qualifier
+		count := 0
+		for count < len(cidrs) && cidrs[count].Qualifier == cidrs[0].Qualifier {
+			count++
+		}
+		packed, err := budget.pack(cidrs[0:count])
+		if err != nil {
+			return nil, err
+		}
+		cidrs = cidrs[count:]
 
-		records = append(records, rec)
+		for _, terms := range packed {
+			rec := NewSPF()
+			rec.Terms = terms
+			records = append(records, rec)
+		}
 	}
 	return records, nil
 }
 
-// Returns error if this is not an SPF record
+// A split published on its own can only ever match through an include,
+// which matches when the split passes. Returns the split rewritten so all of
+// its mechanisms pass, and the qualifier to include it with so its meaning is
+// kept.
+func (s *SPF) Subrecord() (*SPF, Qualifier) {
+	sub := NewSPF()
+	qualifier := QualifierPass
+	for _, term := range s.Terms {
+		if term.Kind == KindIP4 || term.Kind == KindIP6 {
+			qualifier = term.Qualifier
+			term.Qualifier = QualifierPass
+			sub.Terms = append(sub.Terms, term)
+		}
+	}
+	sub.SetAll(QualifierFail)
+	return sub, qualifier
+}
+
+// Whether a TXT record starts with the SPF version section. "v=spf10" and
+// the like are not SPF records.
+func IsSPF(txt string) bool {
+	fields := strings.Fields(txt)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "v=spf1")
+}
+
+// Returns a *NotSPFError if this is not an SPF record at all, or a
+// *ParseError for the first term that breaks RFC 7208
 func (spf *SPF) Parse(txt string) error {
-	if !strings.HasPrefix(txt, "v=spf1") {
-		return errors.New("Not a valid SPF record: " + txt)
+	if !IsSPF(txt) {
+		return &NotSPFError{Txt: txt}
 	}
+	fields := strings.Fields(txt)
 	// throw away any data in the struct already
-	spf.Ip4 = []string{}
-	spf.Ip6 = []string{}
-	spf.Include = []string{}
+	spf.Terms = []Term{}
+	spf.V = "spf1"
 	// parse
-	for _, part := range strings.Fields(txt) {
-		switch {
-		case strings.HasPrefix(part, "v="):
-			spf.V = part[2:]
-		case strings.HasPrefix(part, "ip4:"):
-			spf.Ip4 = append(spf.Ip4, part[4:])
-		case strings.HasPrefix(part, "ip6:"):
-			spf.Ip6 = append(spf.Ip6, part[4:])
-		case strings.HasPrefix(part, "include:"):
-			spf.Include = append(spf.Include, part[8:])
-		case strings.HasSuffix(part, "all"):
-			spf.AllRune = part[0]
-		default:
-			panic("Unrecognized SPF mechanism " + part)
+	seen := map[Kind]bool{}
+	for i, part := range fields[1:] {
+		term, err := parseTerm(part)
+		if err == nil && seen[term.Kind] && (term.Kind == KindRedirect || term.Kind == KindExp) {
+			err = termError("6", term.Kind.String()+" must not appear more than once")
+		}
+		if err != nil {
+			err.Term = part
+			err.Index = i + 1
+			return err
 		}
+		seen[term.Kind] = true
+		spf.Terms = append(spf.Terms, term)
 	}
 	return nil
 }
 
-// Recursively resolve any includes down to ip4 and ip6 mechanisms only
-func (spf *SPF) Flatten() (*SPF, error) {
-	aggregate := NewSPF()
-	// First copy over any ip4/ip6 entries and all setting
-	if len(spf.Ip4) > 0 {
-		aggregate.Ip4 = make([]string, len(spf.Ip4))
-		copy(aggregate.Ip4, spf.Ip4)
-	}
-	if len(spf.Ip6) > 0 {
-		aggregate.Ip6 = make([]string, len(spf.Ip6))
-		copy(aggregate.Ip6, spf.Ip6)
+// http://tools.ietf.org/html/rfc7208#section-4.6.4
+// Each MX lookup must not lead to more than 10 address lookups
+const MAX_MX_NAMES = 10
+
+// Recursively resolve any includes, and the a and mx mechanisms, down to ip4
+// and ip6 mechanisms. Every other term is kept as it is. Queries stop when
+// the context is done.
+func (spf *SPF) Flatten(ctx context.Context) (*SPF, error) {
+	path := []string{}
+	if spf.Domain != "" {
+		path = append(path, spf.Domain)
 	}
-	aggregate.AllRune = spf.AllRune
+	return spf.flatten(path, &flattenState{
+		root:     len(path),
+		resolver: newResolver(ctx, spf.Querent, spf.Concurrency, spf.MaxQueries),
+	})
+}
 
-	// Then flatten by recursively resolving any includes
-	for _, include := range spf.Include {
-		// This may produce multiple TXT records, not all of which will be SPF
-		txts, err := spf.Querent.Query(include)
-		aggregate.LookupCount++
-		if err != nil {
-			// Net error means bad response, fail because this should not happen
-			return nil, err
-		}
+// Shared by every record one Flatten call goes through
+type flattenState struct {
+	// Length of the path at the record Flatten was called on
+	root     int
+	resolver *resolver
+}
 
-		for _, txt := range txts {
-			rec := NewSPF()
-			// Ignore errors
-			rec.Parse(txt)
-			if len(rec.Include) > 0 {
-				rec, err = rec.Flatten()
+// What an include, a, mx or redirect resolved to
+type resolved struct {
+	recs  []*SPF
+	cidrs []Term
+	ttl   time.Duration
+	err   error
+}
+
+// The includes and redirects followed to get to this record, by domain, are
+// tracked to detect loops and limit the depth
+func (spf *SPF) flatten(path []string, state *flattenState) (*SPF, error) {
+	aggregate := spf.child()
+	aggregate.Domain = spf.Domain
+
+	// Resolve everything up front, side by side, then put the record together
+	// in order
+	results := spf.resolveTerms(path, state)
+
+	hasAll := false
+	for i, term := range spf.Terms {
+		if hasAll && term.Kind.IsMechanism() {
+			// Nothing gets past all
+			continue
+		}
+		switch term.Kind {
+		case KindInclude:
+			recs, err := results[i].recs, results[i].err
+			aggregate.LookupCount++
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range recs {
+				// http://tools.ietf.org/html/rfc7208#section-5.2
+				// include only matches where the included record passes
+				passing, err := rec.passTerms()
 				if err != nil {
 					return nil, err
 				}
+				for _, pass := range passing {
+					pass.Qualifier = term.Qualifier
+					aggregate.addMechanism(pass)
+				}
+				aggregate.addBranch(rec)
+			}
+		case KindA, KindMX:
+			cidrs, err := results[i].cidrs, results[i].err
+			aggregate.LookupCount++
+			if err != nil {
+				return nil, err
 			}
-			aggregate.Append(rec)
-			aggregate.LookupCount += rec.LookupCount
+			aggregate.TTL = minTTL(aggregate.TTL, results[i].ttl)
+			for _, cidr := range cidrs {
+				aggregate.addMechanism(cidr)
+			}
+		case KindAll:
+			hasAll = true
+			aggregate.Terms = append(aggregate.Terms, term)
+		case KindRedirect:
+			// Followed below, once every mechanism is in place
+		default:
+			aggregate.Terms = append(aggregate.Terms, term)
+		}
+	}
+
+	redirect := spf.Values(KindRedirect)
+	if hasAll || len(redirect) == 0 {
+		// http://tools.ietf.org/html/rfc7208#section-6.1
+		// redirect is ignored when there is an all mechanism
+		return aggregate, nil
+	}
+
+	target := redirect[0]
+	var result resolved
+	for i, term := range spf.Terms {
+		if term.Kind == KindRedirect {
+			result = results[i]
+			break
+		}
+	}
+	recs, err := result.recs, result.err
+	aggregate.LookupCount++
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("No SPF record found at redirect=" + target)
+	}
+	for _, rec := range recs {
+		// The target's all decides what happens when nothing else matched
+		allRune, hasAll := rec.All()
+		aggregate.Append(rec)
+		if hasAll {
+			aggregate.SetAll(allRune)
 		}
+		aggregate.addBranch(rec)
 	}
 	return aggregate, nil
 }
 
-// Produces a single TXT SPF record, only including ip4 and ip6, even if it is too long
-func (spf *SPF) AsTXTRecord() string {
-	parts := []string{"v=spf1"}
-	for _, ip4 := range spf.Ip4 {
-		parts = append(parts, "ip4:"+ip4)
+// Carries over what Flatten learned following an include or redirect
+func (spf *SPF) addBranch(rec *SPF) {
+	spf.LookupCount += rec.LookupCount
+	spf.Warnings = append(spf.Warnings, rec.Warnings...)
+	spf.TTL = minTTL(spf.TTL, rec.TTL)
+}
+
+// Resolves the includes, a and mx mechanisms and the redirect of a record
+// side by side. The results are indexed like its terms.
+func (spf *SPF) resolveTerms(path []string, state *flattenState) []resolved {
+	results := make([]resolved, len(spf.Terms))
+	_, hasAll := spf.All()
+	seenAll := false
+	var wg sync.WaitGroup
+	for i, term := range spf.Terms {
+		term, result := term, &results[i]
+		switch {
+		case seenAll && term.Kind.IsMechanism():
+			// Never used, so not worth a query
+		case term.Kind == KindAll:
+			seenAll = true
+		case term.Kind == KindInclude:
+			if strings.Contains(term.Value, "%") {
+				result.err = errors.New("Cannot flatten macros in include:" + term.Value)
+				continue
+			}
+			state.resolver.spawn(&wg, func() {
+				result.recs, result.err = spf.follow(term.Value, path, state)
+			})
+		case term.Kind == KindA || term.Kind == KindMX:
+			state.resolver.spawn(&wg, func() {
+				result.cidrs, result.ttl, result.err = spf.resolveHosts(term, state)
+			})
+		case term.Kind == KindRedirect && !hasAll:
+			if strings.Contains(term.Value, "%") {
+				result.err = errors.New("Cannot flatten macros in redirect=" + term.Value)
+				continue
+			}
+			state.resolver.spawn(&wg, func() {
+				result.recs, result.err = spf.follow(term.Value, path, state)
+			})
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// The ip4 and ip6 mechanisms that pass for exactly the addresses this
+// flattened record passes for. Mechanisms that matched earlier with another
+// qualifier are carved out, as they decide the result for those addresses.
+func (spf *SPF) passTerms() ([]Term, error) {
+	passing := []Term{}
+	_, err := spf.walkNetworks(func(term Term, network *net.IPNet, remaining []*net.IPNet) {
+		if term.Qualifier != QualifierPass {
+			return
+		}
+		if term.Kind != KindAll && len(remaining) == 1 && remaining[0] == network {
+			// Untouched, so keep it the way it was written
+			passing = append(passing, term)
+			return
+		}
+		for _, part := range remaining {
+			passing = append(passing, networkTerm(QualifierPass, part))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return passing, nil
+}
+
+// Follows an include or redirect from the end of the path to domain
+func (spf *SPF) follow(domain string, path []string, state *flattenState) ([]*SPF, error) {
+	next := make([]string, len(path), len(path)+1)
+	copy(next, path)
+	next = append(next, domain)
+	if strInSlice(domain, path) {
+		return nil, &LoopError{Path: next}
+	}
+	if spf.MaxDepth > 0 && len(next)-state.root > spf.MaxDepth {
+		return nil, &DepthError{Path: next, MaxDepth: spf.MaxDepth}
+	}
+	return spf.flattenDomain(domain, next, state)
+}
+
+// Looks up and flattens the SPF records published at an include or redirect
+// target
+func (spf *SPF) flattenDomain(domain string, path []string, state *flattenState) ([]*SPF, error) {
+	// This may produce multiple TXT records, not all of which will be SPF
+	txts, ttl, err := state.resolver.txt(domain)
+	if err != nil {
+		// Net error means bad response, fail because this should not happen
+		return nil, err
+	}
+
+	// Other TXT records are allowed at the same name
+	spfTXTs := []string{}
+	for _, txt := range txts {
+		if IsSPF(txt) {
+			spfTXTs = append(spfTXTs, txt)
+		}
+	}
+	var warning string
+	if len(spfTXTs) > 1 {
+		multiple := &MultipleRecordsError{Domain: domain, Records: spfTXTs}
+		switch spf.MultipleRecordsPolicy {
+		case MultipleRecordsFail:
+			return nil, multiple
+		case MultipleRecordsWarn:
+			warning = multiple.Error() + ", flattened all of them"
+		case MultipleRecordsPick:
+			sort.Strings(spfTXTs)
+			spfTXTs = spfTXTs[:1]
+			warning = multiple.Error() + ", flattened only `" + spfTXTs[0] + "`"
+		}
+	}
+
+	recs := []*SPF{}
+	for _, txt := range spfTXTs {
+		rec := spf.child()
+		rec.Domain = domain
+		err = rec.Parse(txt)
+		if parseErr, ok := err.(*ParseError); ok {
+			parseErr.Domain = domain
+			if spf.ParseErrorPolicy == ParseErrorFail {
+				return nil, parseErr
+			}
+			skipped := spf.child()
+			skipped.Domain = domain
+			skipped.TTL = ttl
+			skipped.Warnings = append(skipped.Warnings, "Skipped "+parseErr.Error())
+			recs = append(recs, skipped)
+			continue
+		}
+		rec, err = rec.flatten(path, state)
+		if err != nil {
+			return nil, err
+		}
+		rec.TTL = minTTL(rec.TTL, ttl)
+		recs = append(recs, rec)
+	}
+	if warning != "" && len(recs) > 0 {
+		recs[0].Warnings = append(recs[0].Warnings, warning)
+	}
+	return recs, nil
+}
+
+// Resolves an a or mx mechanism into ip4 and ip6 mechanisms with the same
+// qualifier, applying its dual CIDR lengths. Also returns the lowest TTL of
+// the answers.
+func (spf *SPF) resolveHosts(term Term, state *flattenState) ([]Term, time.Duration, error) {
+	domain := term.Value
+	if domain == "" {
+		domain = spf.Domain
 	}
-	for _, ip6 := range spf.Ip6 {
-		parts = append(parts, "ip6:"+ip6)
+	if domain == "" {
+		return nil, 0, errors.New("Cannot resolve " + term.String() + " without the domain of the record")
 	}
-	for _, include := range spf.Include {
-		parts = append(parts, "include:"+include)
+	if strings.Contains(domain, "%") {
+		return nil, 0, errors.New("Cannot flatten macros in " + term.String())
+	}
+
+	var ttl time.Duration
+	hosts := []string{domain}
+	if term.Kind == KindMX {
+		var err error
+		hosts, ttl, err = state.resolver.mx(domain)
+		if err != nil && !IsNotFound(err) {
+			return nil, 0, err
+		}
+		if len(hosts) > MAX_MX_NAMES {
+			return nil, 0, fmt.Errorf("%s has %d MX records, more than the limit of %d (RFC 7208 section 4.6.4)", term, len(hosts), MAX_MX_NAMES)
+		}
+	}
+
+	cidrs := []Term{}
+	for _, host := range hosts {
+		ips, ipTTL, err := state.resolver.ip(host)
+		if err != nil && !IsNotFound(err) {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, ipTTL)
+		for _, ip := range ips {
+			cidrs = append(cidrs, hostTerm(term, ip))
+		}
+	}
+	return cidrs, ttl, nil
+}
+
+// The ip4 or ip6 mechanism matching one address of an a or mx mechanism
+func hostTerm(term Term, ip net.IP) Term {
+	length, bits := term.CIDR6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		length, bits = term.CIDR4, 32
+	}
+	if length < 0 {
+		length = bits
+	}
+	mask := net.CIDRMask(length, bits)
+	return networkTerm(term.Qualifier, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+}
+
+// Produces a single TXT SPF record with every term, even if it is too long
+func (spf *SPF) AsTXTRecord() string {
+	parts := []string{"v=" + spf.V}
+	for _, term := range spf.Terms {
+		parts = append(parts, term.String())
 	}
-	parts = append(parts, string(spf.AllRune)+"all")
 	return strings.Join(parts, " ")
 }
+
+// The record as the character-strings it is published as
+func (spf *SPF) AsTXTStrings() []string {
+	return TXTStrings(spf.AsTXTRecord())
+}
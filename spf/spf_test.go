@@ -1,76 +1,153 @@
 package spf
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestAppendSPF(t *testing.T) {
-	r1 := &SPF{
-		V:       "spf1",
-		Ip4:     []string{"1.2.3.4/5", "6.7.8.9/0"},
-		Ip6:     []string{"12:34:56::/78"},
-		Include: []string{},
-		AllRune: '?',
-	}
-	r2 := &SPF{
-		V:       "spf1",
-		Ip4:     []string{"5.4.3.2/1"},
-		Ip6:     []string{"12:34:56::/78", "87:65:43::/21"}, // duplicate
-		Include: []string{"_spf.example.com", "_spf2.example.com"},
-		AllRune: '-',
+func mustParse(t *testing.T, txt string) *SPF {
+	spf := NewSPF()
+	if err := spf.Parse(txt); err != nil {
+		t.Fatalf("Failed to parse `%s`: %s", txt, err)
 	}
+	return spf
+}
+
+func TestAppendSPF(t *testing.T) {
+	r1 := mustParse(t, "v=spf1 ip4:1.2.3.4/5 ip4:6.7.8.9/0 ip6:12:34:56::/78 ?all")
+	// duplicate ip6
+	r2 := mustParse(t, "v=spf1 ip4:5.4.3.2/1 ip6:12:34:56::/78 ip6:87:65:43::/21 include:_spf.example.com include:_spf2.example.com -all")
 	r1.Append(r2)
 
 	ip4exp := []string{"1.2.3.4/5", "6.7.8.9/0", "5.4.3.2/1"}
 	for _, ip4 := range ip4exp {
-		if !strInSlice(ip4, r1.Ip4) {
+		if !strInSlice(ip4, r1.Values(KindIP4)) {
 			t.Errorf("Failed to find string %s in r1.ip4", ip4)
 		}
 	}
 	ip6exp := []string{"12:34:56::/78", "87:65:43::/21"}
 	for _, ip6 := range ip6exp {
-		if !strInSlice(ip6, r1.Ip6) {
+		if !strInSlice(ip6, r1.Values(KindIP6)) {
 			t.Errorf("Failed to find string %s in r1.ip6", ip6)
 		}
 	}
 	incexp := []string{"_spf.example.com", "_spf2.example.com"}
 	for _, inc := range incexp {
-		if !strInSlice(inc, r1.Include) {
+		if !strInSlice(inc, r1.Values(KindInclude)) {
 			t.Errorf("Failed to find string %s in r1.inc", inc)
 		}
 	}
-	if r1.AllRune != '-' {
-		t.Errorf("Failed to set allRune: %c", r1.AllRune)
+	if len(r1.Values(KindIP6)) != 2 {
+		t.Errorf("Duplicate ip6 should not be appended: %v", r1.Values(KindIP6))
+	}
+	if allRune, _ := r1.All(); allRune != '?' {
+		t.Errorf("all should be left untouched: %c", allRune)
+	}
+	if r1.Terms[len(r1.Terms)-1].Kind != KindAll {
+		t.Errorf("all should stay last: %s", r1.AsTXTRecord())
 	}
 }
 
 func TestSplit(t *testing.T) {
 	r1 := NewSPF()
 	for i := 0; i < 100; i++ {
-		r1.Ip4 = append(r1.Ip4, fmt.Sprintf("%d.%d.%d.%d/%d", i, i, i, i, i))
+		ip4 := fmt.Sprintf("%d.%d.%d.%d/%d", i, i, i, i, i)
+		r1.Terms = append(r1.Terms, NewTerm(QualifierPass, KindIP4, ip4))
 	}
-	spfs, err := r1.Split()
+	budget := NewResponseBudget("_spfabcdef.example.com")
+	spfs, err := r1.Split(budget)
 	if err != nil {
 		t.Errorf("Error during split: %s", err)
 	}
-	if len(spfs) != (100/19 + 1) {
+	if len(spfs) != 5 {
 		t.Errorf("Wrong number of SPF records returned: %d", len(spfs))
 	}
-	if len(r1.Ip4) < 100 {
+	count := 0
+	for _, split := range spfs {
+		sub, _ := split.Subrecord()
+		if !budget.Fits(sub.AsTXTRecord()) {
+			t.Errorf("Split is too large: %d octets", budget.ResponseSize(sub.AsTXTRecord()))
+		}
+		count += len(split.Terms)
+	}
+	if count != 100 {
+		t.Errorf("Splits should have every mechanism: %d", count)
+	}
+	if len(r1.Values(KindIP4)) < 100 {
 		t.Error("Split should not have modified original record")
 	}
+
+	// EDNS0 allows larger responses
+	budget.Size = 1232
+	if spfs, _ := r1.Split(budget); len(spfs) != 2 {
+		t.Errorf("Wrong number of SPF records with EDNS0: %d", len(spfs))
+	}
+
+	// Other TXT records at the same name take up room too
+	budget.Size = UDP_RESPONSE_SIZE
+	budget.OtherTXT = []string{strings.Repeat("x", 300)}
+	if spfs, _ := r1.Split(budget); len(spfs) != 14 {
+		t.Errorf("Wrong number of SPF records next to other TXT records: %d", len(spfs))
+	}
+
+	budget.OtherTXT = []string{strings.Repeat("x", 450)}
+	if _, err := r1.Split(budget); err == nil {
+		t.Error("Split should fail when nothing fits")
+	}
+}
+
+func TestResponseSize(t *testing.T) {
+	budget := NewResponseBudget("example.com.")
+	// 12 header, 13+4 question, 12+1+6 answer
+	if size := budget.ResponseSize("v=spf1"); size != 48 {
+		t.Errorf("Wrong response size: %d", size)
+	}
+	// Two character-strings
+	if size := budget.ResponseSize(strings.Repeat("x", 256)); size != 299 {
+		t.Errorf("Wrong response size: %d", size)
+	}
+	budget.Size = 4096
+	if size := budget.ResponseSize("v=spf1"); size != 59 {
+		t.Errorf("Wrong response size with EDNS0: %d", size)
+	}
+}
+
+func TestSplitQualifiers(t *testing.T) {
+	r1 := mustParse(t, "v=spf1 ip4:192.0.2.1 -ip4:192.0.2.0/24 -ip6:2001:db8::/32 ip4:198.51.100.0/24 ~all")
+	spfs, err := r1.Split(NewResponseBudget("_spfabcdef.example.com"))
+	if err != nil {
+		t.Fatalf("Error during split: %s", err)
+	}
+	expected := []string{
+		"v=spf1 ip4:192.0.2.1",
+		"v=spf1 -ip4:192.0.2.0/24 -ip6:2001:db8::/32",
+		"v=spf1 ip4:198.51.100.0/24",
+	}
+	if len(spfs) != len(expected) {
+		t.Fatalf("Wrong number of SPF records returned: %d", len(spfs))
+	}
+	for i, split := range spfs {
+		if split.AsTXTRecord() != expected[i] {
+			t.Errorf("Wrong split %d: %s", i, split.AsTXTRecord())
+		}
+	}
+
+	sub, qualifier := spfs[1].Subrecord()
+	if qualifier != QualifierFail {
+		t.Errorf("Should include with the qualifier of the split: %c", qualifier)
+	}
+	if sub.AsTXTRecord() != "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all" {
+		t.Errorf("Subrecord should pass for its networks: %s", sub.AsTXTRecord())
+	}
 }
 
 func TestSplitWithIncludes(t *testing.T) {
-	r1 := &SPF{
-		V:       "spf1",
-		Ip4:     []string{"5.4.3.2/1"},
-		Ip6:     []string{"87:65:43::/21"},
-		Include: []string{"_spf.example.com", "_spf2.example.com"},
-		AllRune: '~',
-	}
-	_, err := r1.Split()
+	r1 := mustParse(t, "v=spf1 ip4:5.4.3.2/1 ip6:87:65:43::/21 include:_spf.example.com include:_spf2.example.com ~all")
+	_, err := r1.Split(NewResponseBudget("_spfabcdef.example.com"))
 	if err == nil {
 		t.Error("Split should not allow includes")
 	}
@@ -83,32 +160,205 @@ func TestParse(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse: %s", err)
 	}
-	if len(spf.Ip4) != 1 || spf.Ip4[0] != "1.2.3.4/5" {
-		t.Errorf("Didn't get ip4: %v", spf.Ip4)
+	if ip4 := spf.Values(KindIP4); len(ip4) != 1 || ip4[0] != "1.2.3.4/5" {
+		t.Errorf("Didn't get ip4: %v", ip4)
+	}
+	if ip6 := spf.Values(KindIP6); len(ip6) != 1 || ip6[0] != "12:34:56::/78" {
+		t.Errorf("Didn't get ip6: %v", ip6)
 	}
-	if len(spf.Ip6) != 1 || spf.Ip6[0] != "12:34:56::/78" {
-		t.Errorf("Didn't get ip6: %v", spf.Ip6)
+	if include := spf.Values(KindInclude); len(include) != 1 || include[0] != "_spf.example.com" {
+		t.Errorf("Didn't get include: %v", include)
+	}
+	if allRune, _ := spf.All(); allRune != '~' {
+		t.Errorf("Didn't get allRune: %v", allRune)
+	}
+}
+
+func TestParseAllTerms(t *testing.T) {
+	txt := "v=spf1 a -a:mail.example.com/24 ~mx//64 mx:example.org/28//96 ?ptr ptr:example.net " +
+		"exists:%{i}._spf.example.com ip4:192.0.2.1 +ip6:2001:db8::/32 redirect=_spf.example.com " +
+		"exp=explain._spf.%{d} moo=cow"
+	expected := []Term{
+		{QualifierPass, KindA, "", "", -1, -1},
+		{QualifierFail, KindA, "", "mail.example.com", 24, -1},
+		{QualifierSoftFail, KindMX, "", "", -1, 64},
+		{QualifierPass, KindMX, "", "example.org", 28, 96},
+		{QualifierNeutral, KindPTR, "", "", -1, -1},
+		{QualifierPass, KindPTR, "", "example.net", -1, -1},
+		{QualifierPass, KindExists, "", "%{i}._spf.example.com", -1, -1},
+		{QualifierPass, KindIP4, "", "192.0.2.1", -1, -1},
+		{QualifierPass, KindIP6, "", "2001:db8::/32", -1, -1},
+		{QualifierPass, KindRedirect, "", "_spf.example.com", -1, -1},
+		{QualifierPass, KindExp, "", "explain._spf.%{d}", -1, -1},
+		{QualifierPass, KindUnknown, "moo", "cow", -1, -1},
+	}
+	spf := mustParse(t, txt)
+	if len(spf.Terms) != len(expected) {
+		t.Fatalf("Wrong number of terms: %v", spf.Terms)
+	}
+	for i, term := range spf.Terms {
+		if term != expected[i] {
+			t.Errorf("Term %d: expected %+v, got %+v", i, expected[i], term)
+		}
+	}
+	roundTrip := "v=spf1 a -a:mail.example.com/24 ~mx//64 mx:example.org/28//96 ?ptr ptr:example.net " +
+		"exists:%{i}._spf.example.com ip4:192.0.2.1 ip6:2001:db8::/32 redirect=_spf.example.com " +
+		"exp=explain._spf.%{d} moo=cow"
+	if spf.AsTXTRecord() != roundTrip {
+		t.Errorf("Record didn't survive a round trip: %s", spf.AsTXTRecord())
+	}
+}
+
+func TestParseNotSPF(t *testing.T) {
+	for _, txt := range []string{"", "google-site-verification=abc", "v=spf10 ip4:1.2.3.4", "v=spf2.0/pra ~all"} {
+		err := NewSPF().Parse(txt)
+		if _, ok := err.(*NotSPFError); !ok {
+			t.Errorf("Expected NotSPFError for `%s`, got %v", txt, err)
+		}
 	}
-	if len(spf.Include) != 1 || spf.Include[0] != "_spf.example.com" {
-		t.Errorf("Didn't get include: %v", spf.Include)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		txt   string
+		index int
+		rule  string
+	}{
+		{"v=spf1 ip4:1.2.3.4/33", 1, "5.6"},
+		{"v=spf1 ip4:1.2.3.4/ -all", 1, "5.6"},
+		{"v=spf1 ip4:1.2.3 -all", 1, "5.6"},
+		{"v=spf1 ip4:12:34::1 -all", 1, "5.6"},
+		{"v=spf1 ip6:12:34::/129", 1, "5.6"},
+		{"v=spf1 ip6:1.2.3.4", 1, "5.6"},
+		{"v=spf1 ip4:192.0.2.0/024 -all", 1, "5.6"},
+		{"v=spf1 a/24 mx:example.com/33", 2, "5.4"},
+		{"v=spf1 a//129", 1, "5.3"},
+		{"v=spf1 a/024 -all", 1, "5.3"},
+		{"v=spf1 mx//064 -all", 1, "5.4"},
+		{"v=spf1 include: -all", 1, "5.2"},
+		{"v=spf1 include -all", 1, "5.2"},
+		{"v=spf1 a: -all", 1, "5.3"},
+		{"v=spf1 a:/24 -all", 1, "5.3"},
+		{"v=spf1 mx:/24 -all", 1, "5.4"},
+		{"v=spf1 exists: -all", 1, "5.7"},
+		{"v=spf1 redirect=", 1, "6.1"},
+		{"v=spf1 include:localhost", 1, "7.1"},
+		{"v=spf1 include:%{z}.example.com", 1, "7.1"},
+		{"v=spf1 -all:foo", 1, "5.1"},
+		{"v=spf1 foo:example.com", 1, "5"},
+		{"v=spf1 -redirect=example.com", 1, "4.6.1"},
+		{"v=spf1 ip4:1.2.3.4 redirect=a.example.com redirect=b.example.com", 3, "6"},
+		{"v=spf1 ip4:1.2.3.4 ~all ?", 3, "4.6.1"},
 	}
-	if spf.AllRune != '~' {
-		t.Errorf("Didn't get allRune: %v", spf.AllRune)
+	for _, test := range tests {
+		err := NewSPF().Parse(test.txt)
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected ParseError for `%s`, got %v", test.txt, err)
+			continue
+		}
+		if parseErr.Index != test.index || parseErr.Rule != test.rule {
+			t.Errorf("Wrong index or rule for `%s`: %s", test.txt, parseErr)
+		}
 	}
 }
 
+// Without txts, cycles through the responses regardless of the name asked
 type TestQuerent struct {
 	responses [][]string
 	iter      int
+	txts      map[string][]string
+	ips       map[string][]string
+	mxs       map[string][]string
+	ptrs      map[string][]string
+	errs      map[string]error
 }
 
-func (q *TestQuerent) Query(name string) ([]string, error) {
+func (q *TestQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	if err := q.errs[name]; err != nil {
+		return nil, err
+	}
+	if q.txts != nil {
+		txts, ok := q.txts[name]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return txts, nil
+	}
 	q.iter %= len(q.responses)
 	res := q.responses[q.iter]
 	q.iter++
 	return res, nil
 }
 
+func (q *TestQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, ip := range q.ips[name] {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, nil
+}
+
+func (q *TestQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	return q.mxs[name], nil
+}
+
+func (q *TestQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	return q.ptrs[addr], nil
+}
+
+// A TestQuerent whose answers have a TTL per name
+type TestTTLQuerent struct {
+	*TestQuerent
+	ttls map[string]time.Duration
+}
+
+func (q *TestTTLQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	txts, err := q.Query(ctx, name)
+	return txts, q.ttls[name], err
+}
+
+func (q *TestTTLQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	ips, err := q.QueryIP(ctx, name)
+	return ips, q.ttls[name], err
+}
+
+func (q *TestTTLQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	hosts, err := q.QueryMX(ctx, name)
+	return hosts, q.ttls[name], err
+}
+
+func TestFlattenTTL(t *testing.T) {
+	querent := &TestTTLQuerent{
+		TestQuerent: &TestQuerent{
+			txts: map[string][]string{
+				"_spf.vendor.com":  []string{"v=spf1 ip4:192.0.2.0/24 include:_spf2.vendor.com -all"},
+				"_spf2.vendor.com": []string{"v=spf1 ip4:198.51.100.0/24 -all"},
+				"_spf.other.com":   []string{"v=spf1 a:mail.other.com -all"},
+			},
+			ips: map[string][]string{
+				"mail.other.com": []string{"203.0.113.1"},
+			},
+		},
+		ttls: map[string]time.Duration{
+			"_spf.vendor.com":  time.Hour,
+			"_spf2.vendor.com": 5 * time.Minute,
+			"_spf.other.com":   2 * time.Hour,
+			"mail.other.com":   30 * time.Minute,
+		},
+	}
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com include:_spf.other.com -all")
+	r1.Querent = querent
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	// The nested include has the lowest TTL
+	if flat.TTL != 5*time.Minute {
+		t.Errorf("Wrong TTL: %s", flat.TTL)
+	}
+}
+
 func TestFlatten(t *testing.T) {
 	querent := TestQuerent{
 		responses: [][]string{[]string{
@@ -117,15 +367,9 @@ func TestFlatten(t *testing.T) {
 			"v=spf1 ip6:12:34:56::/78 ?all",
 		}},
 	}
-	r1 := &SPF{
-		V:       "spf1",
-		Ip4:     []string{"5.4.3.2/1"},
-		Ip6:     []string{"87:65:43::/21"},
-		Include: []string{"_spf.example.com", "_spf2.example.com"},
-		AllRune: '-',
-		Querent: &querent,
-	}
-	flat, err := r1.Flatten()
+	r1 := mustParse(t, "v=spf1 ip4:5.4.3.2/1 ip6:87:65:43::/21 include:_spf.example.com include:_spf2.example.com -all")
+	r1.Querent = &querent
+	flat, err := r1.Flatten(context.Background())
 
 	if err != nil {
 		t.Errorf("Error during flatten: %s", err)
@@ -133,20 +377,304 @@ func TestFlatten(t *testing.T) {
 
 	ip4exp := []string{"1.2.3.4/5", "5.4.3.2/1"}
 	for _, ip4 := range ip4exp {
-		if !strInSlice(ip4, flat.Ip4) {
+		if !strInSlice(ip4, flat.Values(KindIP4)) {
 			t.Errorf("Failed to find string %s in flat.ip4", ip4)
 		}
 	}
 	ip6exp := []string{"12:34:56::/78", "87:65:43::/21"}
 	for _, ip6 := range ip6exp {
-		if !strInSlice(ip6, flat.Ip6) {
+		if !strInSlice(ip6, flat.Values(KindIP6)) {
 			t.Errorf("Failed to find string %s in flat.ip6", ip6)
 		}
 	}
-	if len(flat.Include) > 0 {
-		t.Errorf("Should not have any includes after flattening: %s", flat.Include)
+	if include := flat.Values(KindInclude); len(include) > 0 {
+		t.Errorf("Should not have any includes after flattening: %s", include)
+	}
+	if allRune, _ := flat.All(); allRune != '-' {
+		t.Errorf("Failed to set allRune: %c", allRune)
+	}
+}
+
+func TestFlattenParseErrorPolicy(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 ip4:1.2.3.4/5 ~all",
+		}, []string{
+			"some-verification=xyz",
+			"v=spf1 ip4:256.0.0.1 ~all",
+		}},
+	}
+	r1 := mustParse(t, "v=spf1 include:_spf.example.com include:_spf2.example.com -all")
+	r1.Querent = &querent
+	_, err := r1.Flatten(context.Background())
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected ParseError, got %v", err)
+	}
+	if parseErr.Domain != "_spf2.example.com" || parseErr.Term != "ip4:256.0.0.1" {
+		t.Errorf("Wrong domain or term in error: %s", parseErr)
+	}
+
+	r1.ParseErrorPolicy = ParseErrorSkip
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	if ip4 := flat.Values(KindIP4); len(ip4) != 1 || ip4[0] != "1.2.3.4/5" {
+		t.Errorf("Only the good record should be flattened: %v", ip4)
+	}
+	if len(flat.Warnings) != 1 {
+		t.Errorf("Expected a warning about the skipped record: %v", flat.Warnings)
+	}
+}
+
+func TestFlattenHosts(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 mx ~all",
+		}},
+		ips: map[string][]string{
+			"example.com":        []string{"192.0.2.10", "2001:db8::10"},
+			"mail.example.com":   []string{"198.51.100.7"},
+			"mx1.vendor.com":     []string{"203.0.113.1"},
+			"mx2.vendor.com":     []string{"203.0.113.129", "2001:db8:1::1"},
+			"mx.other.example":   []string{"192.0.2.200"},
+			"unused.example.com": []string{"10.0.0.1"},
+		},
+		mxs: map[string][]string{
+			"vendor.com":    []string{"mx1.vendor.com", "mx2.vendor.com"},
+			"other.example": []string{"mx.other.example"},
+		},
+	}
+	r1 := mustParse(t, "v=spf1 a -a:mail.example.com/24 mx:other.example//64 include:vendor.com ~all")
+	r1.Domain = "example.com"
+	r1.Querent = &querent
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+
+	expected := "v=spf1 ip4:192.0.2.10 ip6:2001:db8::10 -ip4:198.51.100.0/24 ip4:192.0.2.200 " +
+		"ip4:203.0.113.1 ip4:203.0.113.129 ip6:2001:db8:1::1 ~all"
+	if flat.AsTXTRecord() != expected {
+		t.Errorf("Wrong flattened record: %s", flat.AsTXTRecord())
+	}
+	// a, a, mx, include and the mx inside it
+	if flat.LookupCount != 5 {
+		t.Errorf("Wrong lookup count: %d", flat.LookupCount)
+	}
+}
+
+func TestFlattenTooManyMX(t *testing.T) {
+	querent := TestQuerent{
+		mxs: map[string][]string{"example.com": []string{}},
+	}
+	for i := 0; i < 11; i++ {
+		querent.mxs["example.com"] = append(querent.mxs["example.com"], fmt.Sprintf("mx%d.example.com", i))
+	}
+	r1 := mustParse(t, "v=spf1 mx -all")
+	r1.Domain = "example.com"
+	r1.Querent = &querent
+	if _, err := r1.Flatten(context.Background()); err == nil {
+		t.Error("More than 10 MX names should fail")
+	}
+}
+
+func TestFlattenRedirect(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 ip4:198.51.100.0/24 ?all",
+		}, []string{
+			"v=spf1 ip4:192.0.2.0/24 ~all",
+		}},
+	}
+	r1 := mustParse(t, "v=spf1 ip4:203.0.113.1 include:_spf.example.com redirect=_spf.vendor.com")
+	r1.Domain = "example.com"
+	r1.Querent = &querent
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	expected := "v=spf1 ip4:203.0.113.1 ip4:198.51.100.0/24 ip4:192.0.2.0/24 ~all"
+	if flat.AsTXTRecord() != expected {
+		t.Errorf("Wrong flattened record: %s", flat.AsTXTRecord())
+	}
+	if flat.LookupCount != 2 {
+		t.Errorf("Redirect should count as a lookup: %d", flat.LookupCount)
+	}
+}
+
+func TestFlattenMacros(t *testing.T) {
+	for _, txt := range []string{
+		"v=spf1 include:%{i}._spf.example.com -all",
+		"v=spf1 redirect=%{d}._spf.example.com",
+	} {
+		r1 := mustParse(t, txt)
+		r1.Domain = "example.com"
+		r1.Querent = &TestQuerent{}
+		_, err := r1.Flatten(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "Cannot flatten macros") {
+			t.Errorf("Macros in `%s` should not be flattened, got %v", txt, err)
+		}
+	}
+}
+
+func TestFlattenRedirectWithAll(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 ip4:192.0.2.0/24 ~all",
+		}},
+	}
+	r1 := mustParse(t, "v=spf1 ip4:203.0.113.1 redirect=_spf.vendor.com -all")
+	r1.Querent = &querent
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+	if flat.AsTXTRecord() != "v=spf1 ip4:203.0.113.1 -all" {
+		t.Errorf("Redirect should be ignored when there is an all: %s", flat.AsTXTRecord())
+	}
+	if flat.LookupCount != 0 {
+		t.Errorf("Ignored redirect should not count as a lookup: %d", flat.LookupCount)
+	}
+}
+
+func TestFlattenRedirectLoop(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.com",
+		}},
+	}
+	r1 := mustParse(t, "v=spf1 redirect=_spf.vendor.com")
+	r1.Domain = "_spf.example.com"
+	r1.Querent = &querent
+	_, err := r1.Flatten(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "_spf.example.com -> _spf.vendor.com -> _spf.example.com") {
+		t.Errorf("Expected a redirect loop error, got %v", err)
+	}
+	if _, ok := err.(*LoopError); !ok {
+		t.Errorf("Expected a *LoopError, got %T", err)
+	}
+}
+
+func TestFlattenIncludeLoop(t *testing.T) {
+	querent := &TestQuerent{
+		txts: map[string][]string{
+			"_spf.vendor.com": []string{"v=spf1 ip4:192.0.2.0/24 include:_spf.other.com -all"},
+			"_spf.other.com":  []string{"v=spf1 include:_spf.third.com -all"},
+			"_spf.third.com":  []string{"v=spf1 ip4:198.51.100.0/24 include:_spf.vendor.com -all"},
+		},
+	}
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com -all")
+	r1.Domain = "example.com"
+	r1.Querent = querent
+	_, err := r1.Flatten(context.Background())
+	loop, ok := err.(*LoopError)
+	if !ok {
+		t.Fatalf("Expected a *LoopError, got %v", err)
+	}
+	expected := "example.com -> _spf.vendor.com -> _spf.other.com -> _spf.third.com -> _spf.vendor.com"
+	if strings.Join(loop.Path, " -> ") != expected {
+		t.Errorf("Wrong loop path: %s", err)
+	}
+
+	// The same include under different parents is not a loop
+	querent.txts["_spf.third.com"] = []string{"v=spf1 ip4:198.51.100.0/24 -all"}
+	r1 = mustParse(t, "v=spf1 include:_spf.vendor.com include:_spf.third.com -all")
+	r1.Querent = querent
+	if _, err := r1.Flatten(context.Background()); err != nil {
+		t.Errorf("Error during flatten: %s", err)
+	}
+}
+
+func TestFlattenMultipleRecords(t *testing.T) {
+	querent := &TestQuerent{
+		txts: map[string][]string{
+			"_spf.vendor.com": []string{"v=spf1 ip4:198.51.100.0/24 -all", "verification=abc", "v=spf1 ip4:192.0.2.0/24 -all"},
+		},
+	}
+	r1 := mustParse(t, "v=spf1 include:_spf.vendor.com -all")
+	r1.Querent = querent
+	_, err := r1.Flatten(context.Background())
+	multiple, ok := err.(*MultipleRecordsError)
+	if !ok || multiple.Domain != "_spf.vendor.com" || len(multiple.Records) != 2 {
+		t.Fatalf("Expected a *MultipleRecordsError, got %v", err)
+	}
+
+	r1.MultipleRecordsPolicy = MultipleRecordsWarn
+	flat, err := r1.Flatten(context.Background())
+	if err != nil || flat.AsTXTRecord() != "v=spf1 ip4:198.51.100.0/24 ip4:192.0.2.0/24 -all" || len(flat.Warnings) != 1 {
+		t.Errorf("Should flatten both with a warning: %v %v %v", flat, flat.Warnings, err)
+	}
+
+	r1.MultipleRecordsPolicy = MultipleRecordsPick
+	flat, err = r1.Flatten(context.Background())
+	if err != nil || flat.AsTXTRecord() != "v=spf1 ip4:192.0.2.0/24 -all" || len(flat.Warnings) != 1 ||
+		!strings.Contains(flat.Warnings[0], "flattened only `v=spf1 ip4:192.0.2.0/24 -all`") {
+		t.Errorf("Should flatten the first in order with a warning: %v %v %v", flat, flat.Warnings, err)
+	}
+}
+
+func TestFlattenLimits(t *testing.T) {
+	querent := &TestQuerent{
+		txts: map[string][]string{
+			"a.example.com": []string{"v=spf1 include:b.example.com -all"},
+			"b.example.com": []string{"v=spf1 include:c.example.com -all"},
+			"c.example.com": []string{"v=spf1 a:mail.example.com mx:example.com -all"},
+		},
+		ips: map[string][]string{
+			"mail.example.com": []string{"192.0.2.1"},
+			"mx.example.com":   []string{"192.0.2.2"},
+		},
+		mxs: map[string][]string{
+			"example.com": []string{"mx.example.com", "mx.example.com"},
+		},
+	}
+	r1 := mustParse(t, "v=spf1 include:a.example.com -all")
+	r1.Querent = querent
+	if _, err := r1.Flatten(context.Background()); err != nil {
+		t.Fatalf("Error during flatten: %s", err)
+	}
+
+	r1.MaxDepth = 2
+	_, err := r1.Flatten(context.Background())
+	if depthErr, ok := err.(*DepthError); !ok || len(depthErr.Path) != 3 {
+		t.Errorf("Expected a *DepthError, got %v", err)
+	}
+
+	// 3 TXT, 1 for a, then the MX and its host, which is only queried once
+	r1.MaxDepth = 0
+	r1.MaxQueries = 5
+	_, err = r1.Flatten(context.Background())
+	if budgetErr, ok := err.(*QueryBudgetError); !ok || budgetErr.Name != "mx.example.com" {
+		t.Errorf("Expected a *QueryBudgetError, got %v", err)
+	}
+	r1.MaxQueries = 6
+	if _, err := r1.Flatten(context.Background()); err != nil {
+		t.Errorf("Error during flatten: %s", err)
+	}
+}
+
+func TestFlattenQualifiers(t *testing.T) {
+	querent := TestQuerent{
+		responses: [][]string{[]string{
+			"v=spf1 -ip4:10.0.0.1 ip4:10.0.0.0/24 ~ip4:10.0.1.0/24 -all",
+		}, []string{
+			"v=spf1 -ip4:0.0.0.0/1 -ip6:::/0 +all",
+		}},
+	}
+	r1 := mustParse(t, "v=spf1 -include:_spf.vendor.com ip4:192.0.2.1 ?include:_spf.other.com ~all ip4:198.51.100.1")
+	r1.Querent = &querent
+	flat, err := r1.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Error during flatten: %s", err)
 	}
-	if flat.AllRune != '-' {
-		t.Errorf("Failed to set allRune: %c", flat.AllRune)
+	// Only what passes in the included records matches, with the qualifier
+	// of the include. The mechanism after all can never match.
+	expected := "v=spf1 -ip4:10.0.0.0 -ip4:10.0.0.2/31 -ip4:10.0.0.4/30 -ip4:10.0.0.8/29 " +
+		"-ip4:10.0.0.16/28 -ip4:10.0.0.32/27 -ip4:10.0.0.64/26 -ip4:10.0.0.128/25 ip4:192.0.2.1 " +
+		"?ip4:128.0.0.0/1 ~all"
+	if flat.AsTXTRecord() != expected {
+		t.Errorf("Wrong flattened record: %s", flat.AsTXTRecord())
 	}
 }
@@ -0,0 +1,310 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-4.6.2
+// Determines the result when a mechanism matches
+type Qualifier byte
+
+const (
+	QualifierPass     Qualifier = '+'
+	QualifierFail     Qualifier = '-'
+	QualifierSoftFail Qualifier = '~'
+	QualifierNeutral  Qualifier = '?'
+)
+
+func isQualifier(c byte) bool {
+	switch Qualifier(c) {
+	case QualifierPass, QualifierFail, QualifierSoftFail, QualifierNeutral:
+		return true
+	}
+	return false
+}
+
+// Every mechanism and modifier defined by RFC 7208, plus a catch-all for
+// modifiers we don't know about (which must be ignored, not rejected)
+type Kind int
+
+const (
+	KindAll Kind = iota
+	KindInclude
+	KindA
+	KindMX
+	KindPTR
+	KindIP4
+	KindIP6
+	KindExists
+	KindRedirect
+	KindExp
+	KindUnknown
+)
+
+var mechanismKinds = map[string]Kind{
+	"all":     KindAll,
+	"include": KindInclude,
+	"a":       KindA,
+	"mx":      KindMX,
+	"ptr":     KindPTR,
+	"ip4":     KindIP4,
+	"ip6":     KindIP6,
+	"exists":  KindExists,
+}
+
+var kindNames = map[Kind]string{
+	KindAll:      "all",
+	KindInclude:  "include",
+	KindA:        "a",
+	KindMX:       "mx",
+	KindPTR:      "ptr",
+	KindIP4:      "ip4",
+	KindIP6:      "ip6",
+	KindExists:   "exists",
+	KindRedirect: "redirect",
+	KindExp:      "exp",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+func (k Kind) IsMechanism() bool {
+	return k <= KindExists
+}
+
+// A single mechanism or modifier of an SPF record
+type Term struct {
+	// Only meaningful for mechanisms
+	Qualifier Qualifier
+	Kind      Kind
+	// Name of an unknown modifier, empty otherwise
+	Name string
+	// The domain-spec, ip network or modifier value, whichever applies
+	Value string
+	// Dual CIDR lengths of a and mx mechanisms, -1 when not given
+	CIDR4 int
+	CIDR6 int
+}
+
+func NewTerm(q Qualifier, kind Kind, value string) Term {
+	return Term{
+		Qualifier: q,
+		Kind:      kind,
+		Value:     value,
+		CIDR4:     -1,
+		CIDR6:     -1,
+	}
+}
+
+func (t Term) String() string {
+	switch {
+	case t.Kind == KindUnknown:
+		return t.Name + "=" + t.Value
+	case !t.Kind.IsMechanism():
+		return t.Kind.String() + "=" + t.Value
+	}
+
+	var s string
+	// all gets an explicit qualifier, others only when it isn't the default
+	if t.Kind == KindAll || t.Qualifier != QualifierPass {
+		s = string(t.Qualifier)
+	}
+	s += t.Kind.String()
+	if t.Value != "" {
+		s += ":" + t.Value
+	}
+	if t.CIDR4 >= 0 && (t.Kind == KindA || t.Kind == KindMX) {
+		s += "/" + strconv.Itoa(t.CIDR4)
+	}
+	if t.CIDR6 >= 0 && (t.Kind == KindA || t.Kind == KindMX) {
+		s += "//" + strconv.Itoa(t.CIDR6)
+	}
+	return s
+}
+
+// name = ALPHA *( ALPHA / DIGIT / "-" / "_" / "." )
+var termNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.]*`)
+
+// domain-spec [ ip4-cidr-length ] [ "/" ip6-cidr-length ]
+var dualCIDRRe = regexp.MustCompile(`^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$`)
+
+// Section of RFC 7208 that defines each term's syntax
+var kindSections = map[Kind]string{
+	KindAll:      "5.1",
+	KindInclude:  "5.2",
+	KindA:        "5.3",
+	KindMX:       "5.4",
+	KindPTR:      "5.5",
+	KindIP4:      "5.6",
+	KindIP6:      "5.6",
+	KindExists:   "5.7",
+	KindRedirect: "6.1",
+	KindExp:      "6.2",
+	KindUnknown:  "6",
+}
+
+func termError(rule, reason string) *ParseError {
+	return &ParseError{Rule: rule, Reason: reason}
+}
+
+// Parses one whitespace separated term. The returned error only carries
+// the rule and reason, the caller knows where the term is.
+func parseTerm(part string) (Term, *ParseError) {
+	term := NewTerm(QualifierPass, KindAll, "")
+
+	rest := part
+	qualified := false
+	if len(rest) > 0 && isQualifier(rest[0]) {
+		term.Qualifier = Qualifier(rest[0])
+		rest = rest[1:]
+		qualified = true
+	}
+
+	name := termNameRe.FindString(rest)
+	if name == "" {
+		return term, termError("4.6.1", "not a mechanism or modifier")
+	}
+	rest = rest[len(name):]
+
+	if strings.HasPrefix(rest, "=") {
+		if qualified {
+			return term, termError("4.6.1", "modifiers cannot have a qualifier")
+		}
+		term.Value = rest[1:]
+		switch strings.ToLower(name) {
+		case "redirect":
+			term.Kind = KindRedirect
+		case "exp":
+			term.Kind = KindExp
+		default:
+			// Unknown modifiers are ignored, whatever their value
+			term.Kind = KindUnknown
+			term.Name = name
+			return term, nil
+		}
+		return term, checkDomainSpec(term)
+	}
+
+	if rest != "" && rest[0] != ':' && rest[0] != '/' {
+		return term, termError("4.6.1", "not a mechanism or modifier")
+	}
+
+	kind, ok := mechanismKinds[strings.ToLower(name)]
+	if !ok {
+		return term, termError("5", "unknown mechanism "+name)
+	}
+	term.Kind = kind
+	section := kindSections[kind]
+
+	switch kind {
+	case KindAll:
+		if rest != "" {
+			return term, termError(section, "all takes no arguments")
+		}
+		return term, nil
+	case KindA, KindMX:
+		hasDomain := strings.HasPrefix(rest, ":")
+		m := dualCIDRRe.FindStringSubmatch(strings.TrimPrefix(rest, ":"))
+		term.Value = m[1]
+		var err *ParseError
+		if term.CIDR4, err = parseCIDRLength(section, m[2], 32); err != nil {
+			return term, err
+		}
+		if term.CIDR6, err = parseCIDRLength(section, m[3], 128); err != nil {
+			return term, err
+		}
+		if term.Value == "" {
+			if hasDomain {
+				// Also a:/24, where only a dual-cidr-length follows the colon
+				return term, termError(section, "empty domain-spec")
+			}
+			return term, nil
+		}
+		return term, checkDomainSpec(term)
+	case KindIP4, KindIP6:
+		if !strings.HasPrefix(rest, ":") {
+			return term, termError(section, "missing network")
+		}
+		term.Value = rest[1:]
+		return term, checkNetwork(term)
+	default:
+		if rest == "" && kind == KindPTR {
+			// Only ptr may leave out its domain-spec
+			return term, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return term, termError(section, "missing domain-spec")
+		}
+		term.Value = rest[1:]
+		return term, checkDomainSpec(term)
+	}
+}
+
+// ip4-cidr-length and ip6-cidr-length, -1 when not given. Errors are
+// reported under the section of the term they belong to.
+func parseCIDRLength(section, digits string, max int) (int, *ParseError) {
+	if digits == "" {
+		return -1, nil
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return -1, termError(section, fmt.Sprintf("CIDR length /%s has a leading zero", digits))
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil || length > max {
+		return -1, termError(section, fmt.Sprintf("CIDR length /%s is out of range 0-%d", digits, max))
+	}
+	return length, nil
+}
+
+// ip4-network [ ip4-cidr-length ] or ip6-network [ ip6-cidr-length ]
+func checkNetwork(term Term) *ParseError {
+	addr := term.Value
+	length := ""
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr, length = addr[:i], addr[i+1:]
+		if length == "" {
+			return termError("5.6", "empty CIDR length")
+		}
+	}
+	ip := net.ParseIP(addr)
+	if term.Kind == KindIP4 {
+		if ip == nil || strings.Contains(addr, ":") {
+			return termError("5.6", "invalid IPv4 address "+addr)
+		}
+		_, err := parseCIDRLength("5.6", length, 32)
+		return err
+	}
+	if ip == nil || !strings.Contains(addr, ":") {
+		return termError("5.6", "invalid IPv6 address "+addr)
+	}
+	_, err := parseCIDRLength("5.6", length, 128)
+	return err
+}
+
+// http://tools.ietf.org/html/rfc7208#section-7.1
+// macro-expand = ( "%{" macro-letter transformers *delimiter "}" ) / "%%" / "%_" / "%-"
+// The c, r and t macro letters are only allowed in explanation strings.
+const macroExpand = `%\{[slodiphvSLODIPHV][0-9]*[rR]?[.\-+,/_=]*\}|%%|%_|%-`
+
+var domainSpecRe = regexp.MustCompile(`^(?:` + macroExpand + `|[\x21-\x24\x26-\x7e])+$`)
+
+// domain-end = ( "." toplabel [ "." ] ) / macro-expand
+var domainEndRe = regexp.MustCompile(`(?:\.(?:[A-Za-z0-9]*[A-Za-z][A-Za-z0-9]*|[A-Za-z0-9]+-[A-Za-z0-9-]*[A-Za-z0-9])\.?|` + macroExpand + `)$`)
+
+func checkDomainSpec(term Term) *ParseError {
+	section := kindSections[term.Kind]
+	switch {
+	case term.Value == "":
+		return termError(section, "empty domain-spec")
+	case !domainSpecRe.MatchString(term.Value):
+		return termError("7.1", "invalid macro in domain-spec "+term.Value)
+	case !domainEndRe.MatchString(term.Value):
+		return termError("7.1", "domain-spec doesn't end in a top-level label "+term.Value)
+	}
+	return nil
+}
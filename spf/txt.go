@@ -0,0 +1,63 @@
+package spf
+
+import (
+	"strings"
+)
+
+// http://tools.ietf.org/html/rfc7208#section-3.3
+// A TXT record longer than one character-string is published as several,
+// which receivers join back together without adding any spaces. Where the
+// cuts fall doesn't matter, so every string but the last is full.
+func TXTStrings(txt string) []string {
+	parts := []string{}
+	for len(txt) > MAX_TXT_STRING {
+		parts = append(parts, txt[:MAX_TXT_STRING])
+		txt = txt[MAX_TXT_STRING:]
+	}
+	return append(parts, txt)
+}
+
+// The zone file presentation of a TXT record, with each character-string
+// quoted. Records that fit in one string are left bare.
+func QuoteTXT(txt string) string {
+	parts := TXTStrings(txt)
+	if len(parts) == 1 {
+		return txt
+	}
+	return quoteStrings(parts)
+}
+
+// Each character-string quoted and escaped, separated by spaces
+func quoteStrings(parts []string) string {
+	quoted := []string{}
+	for _, part := range parts {
+		part = strings.Replace(part, `\`, `\\`, -1)
+		part = strings.Replace(part, `"`, `\"`, -1)
+		quoted = append(quoted, `"`+part+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Joins the character-strings of a TXT record in presentation format back
+// into one. Content that isn't quoted is already a single string.
+func UnquoteTXT(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, `"`) {
+		return content
+	}
+	var joined []byte
+	quoted := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(content):
+			i++
+			joined = append(joined, content[i])
+		case quoted:
+			joined = append(joined, c)
+		}
+	}
+	return string(joined)
+}
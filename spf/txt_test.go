@@ -0,0 +1,40 @@
+package spf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTXTStrings(t *testing.T) {
+	short := "v=spf1 ip4:192.0.2.0/24 -all"
+	if parts := TXTStrings(short); len(parts) != 1 || parts[0] != short {
+		t.Errorf("Short records are one string: %v", parts)
+	}
+	if QuoteTXT(short) != short {
+		t.Errorf("Short records are left bare: %s", QuoteTXT(short))
+	}
+
+	long := "v=spf1 " + strings.Repeat("ip6:2001:db8::/32 ", 30) + "-all"
+	parts := TXTStrings(long)
+	if len(parts) != 3 || len(parts[0]) != 255 || len(parts[1]) != 255 {
+		t.Errorf("Wrong strings: %v", parts)
+	}
+	if strings.Join(parts, "") != long {
+		t.Error("Strings should join back into the record")
+	}
+	if UnquoteTXT(QuoteTXT(long)) != long {
+		t.Errorf("Quoting should round trip: %s", QuoteTXT(long))
+	}
+
+	tests := map[string]string{
+		`"v=spf1 " "-all"`:                  "v=spf1 -all",
+		`  "v=spf1 ip4:192.0.2.1" " -all" `: "v=spf1 ip4:192.0.2.1 -all",
+		`"say \"hi\" \\o/"`:                 `say "hi" \o/`,
+		"v=spf1 -all":                       "v=spf1 -all",
+	}
+	for content, expected := range tests {
+		if UnquoteTXT(content) != expected {
+			t.Errorf("UnquoteTXT(%s) = %s, expected %s", content, UnquoteTXT(content), expected)
+		}
+	}
+}
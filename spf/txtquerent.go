@@ -1,16 +1,159 @@
 package spf
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strings"
+	"time"
 )
 
+// Queries give up when the context is done
 type TXTQuerent interface {
-	Query(string) ([]string, error)
+	Query(context.Context, string) ([]string, error)
+	// Both A and AAAA records
+	QueryIP(context.Context, string) ([]net.IP, error)
+	// Host names of the MX records, most preferred first
+	QueryMX(context.Context, string) ([]string, error)
+	// Names of the PTR records of an IP address
+	QueryPTR(context.Context, string) ([]string, error)
+}
+
+// Querents that also know how long answers may be cached. The TTL returned
+// is the lowest of the records that make up the answer.
+type TTLQuerent interface {
+	TXTQuerent
+	QueryTTL(context.Context, string) ([]string, time.Duration, error)
+	QueryIPTTL(context.Context, string) ([]net.IP, time.Duration, error)
+	QueryMXTTL(context.Context, string) ([]string, time.Duration, error)
+}
+
+// Query, with the TTL if the querent knows it and 0 if it doesn't
+func queryTTL(ctx context.Context, q TXTQuerent, name string) ([]string, time.Duration, error) {
+	if q, ok := q.(TTLQuerent); ok {
+		return q.QueryTTL(ctx, name)
+	}
+	txts, err := q.Query(ctx, name)
+	return txts, 0, err
+}
+
+func queryIPTTL(ctx context.Context, q TXTQuerent, name string) ([]net.IP, time.Duration, error) {
+	if q, ok := q.(TTLQuerent); ok {
+		return q.QueryIPTTL(ctx, name)
+	}
+	ips, err := q.QueryIP(ctx, name)
+	return ips, 0, err
+}
+
+func queryMXTTL(ctx context.Context, q TXTQuerent, name string) ([]string, time.Duration, error) {
+	if q, ok := q.(TTLQuerent); ok {
+		return q.QueryMXTTL(ctx, name)
+	}
+	hosts, err := q.QueryMX(ctx, name)
+	return hosts, 0, err
+}
+
+// The lower of two TTLs, where 0 means unknown
+func minTTL(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
 }
 
 type SimpleTXTQuerent struct {
 }
 
-func (q SimpleTXTQuerent) Query(name string) ([]string, error) {
-	return net.LookupTXT(name)
+func (q SimpleTXTQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+func (q SimpleTXTQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (q SimpleTXTQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for _, mx := range mxs {
+		hosts = append(hosts, mx.Host)
+	}
+	return hosts, nil
+}
+
+func (q SimpleTXTQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// True when the name doesn't exist or has no records of the type asked for.
+// Mechanisms simply don't match such names.
+func IsNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// True when a query failed in a way that may go away by itself, like a
+// timeout or SERVFAIL. Receivers treat these as a temperror rather than a
+// permerror.
+func IsTemporary(err error) bool {
+	switch err := err.(type) {
+	case *TempError:
+		return true
+	case *net.DNSError:
+		return err.IsTimeout || err.IsTemporary
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Answers TXT queries for some names from memory, such as records that are
+// about to be published, and passes everything else on
+type OverlayQuerent struct {
+	TXT     map[string][]string
+	Querent TXTQuerent
+}
+
+func (q *OverlayQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := q.TXT[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+		return txts, nil
+	}
+	return q.Querent.Query(ctx, name)
+}
+
+func (q *OverlayQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	return q.Querent.QueryIP(ctx, name)
+}
+
+func (q *OverlayQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	return q.Querent.QueryMX(ctx, name)
+}
+
+func (q *OverlayQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	return q.Querent.QueryPTR(ctx, addr)
+}
+
+// Answers from memory have no TTL
+func (q *OverlayQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	if txts, ok := q.TXT[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+		return txts, 0, nil
+	}
+	return queryTTL(ctx, q.Querent, name)
+}
+
+func (q *OverlayQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	return queryIPTTL(ctx, q.Querent, name)
+}
+
+func (q *OverlayQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	return queryMXTTL(ctx, q.Querent, name)
 }
@@ -0,0 +1,127 @@
+package spf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// A network and the result a record gives every address in it
+type Authorization struct {
+	Network *net.IPNet
+	Result  Result
+}
+
+// Splits the whole IPv4 and IPv6 address space into networks by the result
+// this flattened record gives them, sorted by address. Addresses no
+// mechanism matches are neutral.
+func (spf *SPF) Authorizations() ([]Authorization, error) {
+	auths := []Authorization{}
+	matched, err := spf.walkNetworks(func(term Term, network *net.IPNet, remaining []*net.IPNet) {
+		for _, part := range remaining {
+			auths = append(auths, Authorization{part, qualifierResults[term.Qualifier]})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range universe() {
+		for _, part := range subtract(network, matched) {
+			auths = append(auths, Authorization{part, ResultNeutral})
+		}
+	}
+	sort.Sort(byAddress(auths))
+	return auths, nil
+}
+
+type byAddress []Authorization
+
+func (a byAddress) Len() int      { return len(a) }
+func (a byAddress) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byAddress) Less(i, j int) bool {
+	x, y := a[i].Network.IP, a[j].Network.IP
+	if len(x) != len(y) {
+		// IPv4 first
+		return len(x) < len(y)
+	}
+	return bytes.Compare(x, y) < 0
+}
+
+// The highest address of a network
+func lastAddress(network *net.IPNet) net.IP {
+	last := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return last
+}
+
+// Networks that the ideal and published records give different results
+type Difference struct {
+	Network   *net.IPNet
+	Ideal     Result
+	Published Result
+}
+
+func (d Difference) String() string {
+	change := "changed result"
+	if d.Ideal == ResultPass {
+		change = "lost coverage"
+	} else if d.Published == ResultPass {
+		change = "gained coverage"
+	}
+	return fmt.Sprintf("%s %s: %s in the ideal record, %s when published", change, d.Network, d.Ideal, d.Published)
+}
+
+// Compares two flattened records address by address
+func Diff(ideal, published *SPF) ([]Difference, error) {
+	before, err := ideal.Authorizations()
+	if err != nil {
+		return nil, err
+	}
+	after, err := published.Authorizations()
+	if err != nil {
+		return nil, err
+	}
+
+	// Both cover the whole address space in order, so walk them side by
+	// side. Networks either nest or are disjoint, so whichever of the two
+	// current ones is smaller is their overlap.
+	diffs := []Difference{}
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		a, b := before[i], after[j]
+		overlap := a.Network
+		if covers(a.Network, b.Network) {
+			overlap = b.Network
+		}
+		if a.Result != b.Result {
+			diffs = append(diffs, Difference{overlap, a.Result, b.Result})
+		}
+		last := lastAddress(overlap)
+		if lastAddress(a.Network).Equal(last) {
+			i++
+		}
+		if lastAddress(b.Network).Equal(last) {
+			j++
+		}
+	}
+	return diffs, nil
+}
+
+// Flattens both records and compares them address by address. The
+// published record is usually the top record of a flattened tree, with a
+// Querent that knows about its subrecords.
+func Verify(ctx context.Context, ideal, published *SPF) ([]Difference, error) {
+	idealFlat, err := ideal.Flatten(ctx)
+	if err != nil {
+		return nil, err
+	}
+	publishedFlat, err := published.Flatten(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(idealFlat, publishedFlat)
+}
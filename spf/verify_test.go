@@ -0,0 +1,79 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestAuthorizations(t *testing.T) {
+	r1 := mustParse(t, "v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/30 ~ip6:2001:db8::/32")
+	auths, err := r1.Authorizations()
+	if err != nil {
+		t.Fatalf("Error computing authorizations: %s", err)
+	}
+	expected := "[{0.0.0.0/1 neutral} {128.0.0.0/2 neutral} {192.0.0.0/23 neutral} {192.0.2.0/32 pass} " +
+		"{192.0.2.1/32 fail} {192.0.2.2/31 pass}"
+	if got := fmt.Sprintf("%v", auths); got[:len(expected)] != expected {
+		t.Errorf("Wrong authorizations: %v", auths)
+	}
+	covered := map[Result]int{}
+	for _, auth := range auths {
+		covered[auth.Result]++
+	}
+	if covered[ResultPass] != 2 || covered[ResultFail] != 1 || covered[ResultSoftFail] != 1 {
+		t.Errorf("Wrong results: %v", covered)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ideal := mustParse(t, "v=spf1 ip4:192.0.2.0/24 -ip4:198.51.100.0/24 ip6:2001:db8::/32 ~all")
+	same := mustParse(t, "v=spf1 ip4:192.0.2.0/25 ip4:192.0.2.128/25 -ip4:198.51.100.0/24 ip6:2001:db8::/32 ~all")
+	diffs, err := Diff(ideal, same)
+	if err != nil {
+		t.Fatalf("Error during diff: %s", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Records should be equivalent: %v", diffs)
+	}
+
+	changed := mustParse(t, "v=spf1 ip4:192.0.2.0/25 ~ip4:198.51.100.0/24 ip4:203.0.113.5 ip6:2001:db8::/32 ~all")
+	diffs, err = Diff(ideal, changed)
+	if err != nil {
+		t.Fatalf("Error during diff: %s", err)
+	}
+	expected := []string{
+		"lost coverage 192.0.2.128/25: pass in the ideal record, softfail when published",
+		"changed result 198.51.100.0/24: fail in the ideal record, softfail when published",
+		"gained coverage 203.0.113.5/32: softfail in the ideal record, pass when published",
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Wrong differences: %v", diffs)
+	}
+	for i, diff := range diffs {
+		if diff.String() != expected[i] {
+			t.Errorf("Wrong difference %d: %s", i, diff)
+		}
+	}
+}
+
+func TestVerifyFlattenedTree(t *testing.T) {
+	querent := testEvaluationQuerent()
+	ideal := mustParse(t, "v=spf1 ip4:192.0.2.0/24 include:_spf.vendor.com -all")
+	ideal.Querent = querent
+	published := mustParse(t, "v=spf1 ip4:192.0.2.0/24 include:_spf1.example.com -include:_spf2.example.com -all")
+	published.Querent = &OverlayQuerent{
+		TXT: map[string][]string{
+			"_spf1.example.com": []string{"v=spf1 ip4:198.51.100.0/25 ip6:2001:db8::/32 -all"},
+			"_spf2.example.com": []string{"v=spf1 ip4:198.51.100.128/25 -all"},
+		},
+		Querent: querent,
+	}
+	diffs, err := Verify(context.Background(), ideal, published)
+	if err != nil {
+		t.Fatalf("Error during verify: %s", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Published tree should be equivalent: %v", diffs)
+	}
+}
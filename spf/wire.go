@@ -0,0 +1,562 @@
+package spf
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The payload size advertised with EDNS0, small enough to avoid IP
+// fragmentation on any path (https://www.dnsflagday.net/2020/)
+const EDNS0_UDP_SIZE = 1232
+
+// Authoritative servers listen here
+const DNS_PORT = "53"
+
+// How long a server may take to answer, whatever the context allows
+const WIRE_TIMEOUT = 5 * time.Second
+
+// Talks DNS to nameservers directly instead of going through the net
+// package, which drops the TTLs of the answers
+type WireQuerent struct {
+	// host:port of recursive resolvers, tried in order until one answers
+	Servers []string
+	// Payload size to advertise with EDNS0, UDP_RESPONSE_SIZE to not use it.
+	// Truncated answers are asked again over TCP either way.
+	UDPSize int
+	// Ask the authoritative servers of each name instead of the resolvers,
+	// which are only used to find them. Skips answers the resolvers cached
+	// before a vendor changed their record.
+	Authoritative bool
+	// Port to reach authoritative servers on, DNS_PORT unless testing
+	AuthoritativePort string
+	// How long one server may take to answer, WIRE_TIMEOUT when 0. Replies
+	// that got lost would be waited for forever otherwise.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// Authoritative servers of each zone found so far, as host:port
+	zones map[string][]string
+}
+
+func NewWireQuerent(servers ...string) *WireQuerent {
+	return &WireQuerent{
+		Servers:           servers,
+		UDPSize:           EDNS0_UDP_SIZE,
+		AuthoritativePort: DNS_PORT,
+		Timeout:           WIRE_TIMEOUT,
+	}
+}
+
+// The nameservers of /etc/resolv.conf, as host:port
+func SystemResolvers() ([]string, error) {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	servers := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], DNS_PORT))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("No nameserver in /etc/resolv.conf")
+	}
+	return servers, nil
+}
+
+// Asks each server in turn until one gives an answer, even if that answer
+// is that the name doesn't exist
+func (q *WireQuerent) ask(ctx context.Context, servers []string, name string, qtype dnsmessage.Type, recurse bool) (*dnsmessage.Message, error) {
+	err := errors.New("No nameservers to ask for " + name)
+	for _, server := range servers {
+		var response *dnsmessage.Message
+		response, err = q.exchange(ctx, server, name, qtype, recurse)
+		if err == nil || IsNotFound(err) || ctx.Err() != nil {
+			return response, err
+		}
+	}
+	return nil, err
+}
+
+// Sends one question to one server and returns the response, or the error
+// its RCODE stands for
+func (q *WireQuerent) exchange(ctx context.Context, server, name string, qtype dnsmessage.Type, recurse bool) (*dnsmessage.Message, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	question, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	request := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: recurse,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  question,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	udpSize := UDP_RESPONSE_SIZE
+	if q.UDPSize > UDP_RESPONSE_SIZE {
+		// http://tools.ietf.org/html/rfc6891#section-6.1.2
+		udpSize = q.UDPSize
+		var opt dnsmessage.Resource
+		if err := opt.Header.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		opt.Body = &dnsmessage.OPTResource{}
+		request.Additionals = append(request.Additionals, opt)
+	}
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := q.exchangeUDP(ctx, server, packed, udpSize, request.Questions[0])
+	if err == nil && response.Truncated {
+		// http://tools.ietf.org/html/rfc7766#section-5
+		response, err = q.exchangeTCP(ctx, server, packed, request.Questions[0])
+	}
+	if err != nil {
+		return nil, q.netError(server, name, err)
+	}
+	return response, q.rcodeError(server, name, response.RCode)
+}
+
+func (q *WireQuerent) exchangeUDP(ctx context.Context, server string, packed []byte, udpSize int, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	conn, err := q.dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint16(packed)
+	buf := make([]byte, udpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		response, err := unpack(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !answersQuestion(response, id, question) {
+			// Not the answer to our question, keep waiting for it
+			continue
+		}
+		return response, nil
+	}
+}
+
+// Messages over TCP are prefixed with their length
+func (q *WireQuerent) exchangeTCP(ctx context.Context, server string, packed []byte, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	conn, err := q.dial(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	prefixed := make([]byte, 2, 2+len(packed))
+	binary.BigEndian.PutUint16(prefixed, uint16(len(packed)))
+	if _, err := conn.Write(append(prefixed, packed...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	response, err := unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !answersQuestion(response, binary.BigEndian.Uint16(packed), question) {
+		return nil, errors.New("Response over TCP doesn't answer the question")
+	}
+	return response, nil
+}
+
+// Connections give up at the deadline of the context or after Timeout,
+// whichever comes first
+func (q *WireQuerent) dial(ctx context.Context, network, server string) (net.Conn, error) {
+	timeout := q.Timeout
+	if timeout <= 0 {
+		timeout = WIRE_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// A truncated response may be cut off anywhere after its question, so
+// nothing after that is read
+func unpack(msg []byte) (*dnsmessage.Message, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if header.Truncated {
+		questions, err := parser.AllQuestions()
+		if err != nil {
+			return nil, err
+		}
+		return &dnsmessage.Message{Header: header, Questions: questions}, nil
+	}
+	var response dnsmessage.Message
+	if err := response.Unpack(msg); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func answersQuestion(response *dnsmessage.Message, id uint16, question dnsmessage.Question) bool {
+	return response.Response && response.ID == id && len(response.Questions) == 1 &&
+		strings.EqualFold(response.Questions[0].Name.String(), question.Name.String()) &&
+		response.Questions[0].Type == question.Type
+}
+
+func (q *WireQuerent) netError(server, name string, err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &net.DNSError{Err: "i/o timeout", Name: name, Server: server, IsTimeout: true}
+	}
+	return err
+}
+
+// NXDOMAIN means the name doesn't exist, SERVFAIL may go away with a retry
+func (q *WireQuerent) rcodeError(server, name string, rcode dnsmessage.RCode) error {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return nil
+	case dnsmessage.RCodeNameError:
+		return &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	case dnsmessage.RCodeServerFailure:
+		return &net.DNSError{Err: "server misbehaving", Name: name, Server: server, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "server refused: " + rcode.String(), Name: name, Server: server}
+}
+
+// The authoritative servers of the zone name is in. Walks up from name until
+// the resolvers know nameservers for it, remembering them for every name on
+// the way.
+func (q *WireQuerent) authorities(ctx context.Context, name string) ([]string, error) {
+	zone := strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	walked := []string{}
+	for {
+		q.mu.Lock()
+		servers, ok := q.zones[zone]
+		q.mu.Unlock()
+		if ok {
+			q.remember(walked, servers)
+			return servers, nil
+		}
+
+		hosts, _, err := q.resolve(ctx, zone, dnsmessage.TypeNS)
+		if err != nil && !IsNotFound(err) {
+			return nil, err
+		}
+		if len(hosts) > 0 {
+			servers := []string{}
+			for _, host := range hosts {
+				servers = append(servers, q.addresses(ctx, host.Body.(*dnsmessage.NSResource).NS.String())...)
+			}
+			if len(servers) == 0 {
+				return nil, &net.DNSError{Err: "no address for any nameserver", Name: zone, IsTemporary: true}
+			}
+			q.remember(append(walked, zone), servers)
+			return servers, nil
+		}
+
+		if zone == "." {
+			return nil, &net.DNSError{Err: "no nameservers found", Name: name, IsTemporary: true}
+		}
+		// Not a zone of its own, try its parent
+		walked = append(walked, zone)
+		if i := strings.Index(zone, "."); i < len(zone)-1 {
+			zone = zone[i+1:]
+		} else {
+			zone = "."
+		}
+	}
+}
+
+// The IPv4 and IPv6 addresses of a nameserver as host:port, none if it
+// cannot be resolved
+func (q *WireQuerent) addresses(ctx context.Context, host string) []string {
+	servers := []string{}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, _, err := q.resolve(ctx, host, qtype)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			var addr net.IP
+			switch body := ip.Body.(type) {
+			case *dnsmessage.AResource:
+				addr = body.A[:]
+			case *dnsmessage.AAAAResource:
+				addr = body.AAAA[:]
+			}
+			servers = append(servers, net.JoinHostPort(addr.String(), q.AuthoritativePort))
+		}
+	}
+	return servers
+}
+
+func (q *WireQuerent) remember(names []string, servers []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.zones == nil {
+		q.zones = map[string][]string{}
+	}
+	for _, name := range names {
+		q.zones[name] = servers
+	}
+}
+
+// Records of the type asked for from the resolvers, and the lowest TTL of
+// those and any CNAMEs that led to them
+func (q *WireQuerent) resolve(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	response, err := q.ask(ctx, q.Servers, name, qtype, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	found, ttl, _ := filterAnswers(response, qtype)
+	return found, ttl, nil
+}
+
+// The records of the type asked for, the lowest TTL of those and of the
+// CNAMEs that led to them, and the name the last CNAME points to
+func filterAnswers(response *dnsmessage.Message, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, string) {
+	found := []dnsmessage.Resource{}
+	var ttl time.Duration
+	target := ""
+	for _, answer := range response.Answers {
+		switch answer.Header.Type {
+		case qtype:
+			found = append(found, answer)
+		case dnsmessage.TypeCNAME:
+			target = answer.Body.(*dnsmessage.CNAMEResource).CNAME.String()
+		default:
+			continue
+		}
+		ttl = minTTL(ttl, time.Duration(answer.Header.TTL)*time.Second)
+	}
+	return found, ttl, target
+}
+
+// Authoritative servers only follow CNAMEs within their own zones
+const MAX_CNAMES = 8
+
+// The answers of the type asked for, and the lowest TTL of those and any
+// CNAMEs that led to them. Having none is the same as the name not
+// existing, like with the net package.
+func (q *WireQuerent) answers(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	if !q.Authoritative {
+		found, ttl, err := q.resolve(ctx, name, qtype)
+		if err == nil && len(found) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return found, ttl, err
+	}
+
+	var ttl time.Duration
+	for i := 0; i <= MAX_CNAMES; i++ {
+		servers, err := q.authorities(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		response, err := q.ask(ctx, servers, name, qtype, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		found, foundTTL, target := filterAnswers(response, qtype)
+		ttl = minTTL(ttl, foundTTL)
+		if len(found) > 0 {
+			return found, ttl, nil
+		}
+		if target == "" {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		// Continue at the zone the CNAME points into
+		name = target
+	}
+	return nil, 0, &net.DNSError{Err: "too many CNAMEs", Name: name}
+}
+
+func (q *WireQuerent) QueryTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	answers, ttl, err := q.answers(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, 0, err
+	}
+	txts := []string{}
+	for _, answer := range answers {
+		// The character-strings of a record make up one string
+		txts = append(txts, strings.Join(answer.Body.(*dnsmessage.TXTResource).TXT, ""))
+	}
+	return txts, ttl, nil
+}
+
+// The TXT records each authoritative nameserver of name has, keyed by
+// server, to tell when a change has reached all of them. Servers that
+// don't know the name have none. The TTL is the highest any of them gave,
+// how long resolvers may keep what one of them answered.
+func (q *WireQuerent) QueryAuthoritiesTTL(ctx context.Context, name string) (map[string][]string, time.Duration, error) {
+	servers, err := q.authorities(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	byServer := map[string][]string{}
+	var ttl time.Duration
+	for _, server := range servers {
+		response, err := q.exchange(ctx, server, name, dnsmessage.TypeTXT, false)
+		if IsNotFound(err) {
+			byServer[server] = []string{}
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		answers, answersTTL, _ := filterAnswers(response, dnsmessage.TypeTXT)
+		if answersTTL > ttl {
+			ttl = answersTTL
+		}
+		txts := []string{}
+		for _, answer := range answers {
+			txts = append(txts, strings.Join(answer.Body.(*dnsmessage.TXTResource).TXT, ""))
+		}
+		byServer[server] = txts
+	}
+	return byServer, ttl, nil
+}
+
+// A and AAAA records together, like net.LookupIP
+func (q *WireQuerent) QueryIPTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	ips := []net.IP{}
+	var ttl time.Duration
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, answersTTL, err := q.answers(ctx, name, qtype)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, answersTTL)
+		for _, answer := range answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
+
+func (q *WireQuerent) QueryMXTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	answers, ttl, err := q.answers(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+	mxs := []*dnsmessage.MXResource{}
+	for _, answer := range answers {
+		mxs = append(mxs, answer.Body.(*dnsmessage.MXResource))
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := []string{}
+	for _, mx := range mxs {
+		hosts = append(hosts, mx.MX.String())
+	}
+	return hosts, ttl, nil
+}
+
+func (q *WireQuerent) Query(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := q.QueryTTL(ctx, name)
+	return txts, err
+}
+
+func (q *WireQuerent) QueryIP(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := q.QueryIPTTL(ctx, name)
+	return ips, err
+}
+
+func (q *WireQuerent) QueryMX(ctx context.Context, name string) ([]string, error) {
+	hosts, _, err := q.QueryMXTTL(ctx, name)
+	return hosts, err
+}
+
+func (q *WireQuerent) QueryPTR(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	answers, _, err := q.answers(ctx, reverseName(ip), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, answer := range answers {
+		names = append(names, answer.Body.(*dnsmessage.PTRResource).PTR.String())
+	}
+	return names, nil
+}
+
+// The in-addr.arpa or ip6.arpa name of an address
+func reverseName(ip net.IP) string {
+	parts := strings.Split(dottedIP(ip), ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	if ip.To4() != nil {
+		return strings.Join(parts, ".") + ".in-addr.arpa."
+	}
+	return strings.Join(parts, ".") + ".ip6.arpa."
+}
@@ -0,0 +1,399 @@
+package spf
+
+import (
+	"context"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A DNS server on a local UDP and TCP port that answers from a table of
+// records. Responses too large for UDP are truncated.
+type testDNSServer struct {
+	conn     net.PacketConn
+	listener net.Listener
+	records  map[string][]dnsmessage.Resource
+	rcodes   map[string]dnsmessage.RCode
+
+	mu sync.Mutex
+	// Questions asked over TCP, and with recursion desired
+	tcpQueries       int
+	recursiveQueries int
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := &testDNSServer{
+		conn:     conn,
+		listener: listener,
+		records:  map[string][]dnsmessage.Resource{},
+		rcodes:   map[string]dnsmessage.RCode{},
+	}
+	go s.serve()
+	go s.serveTCP()
+	return s
+}
+
+func (s *testDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) port() string {
+	_, port, _ := net.SplitHostPort(s.addr())
+	return port
+}
+
+func (s *testDNSServer) close() {
+	s.conn.Close()
+	s.listener.Close()
+}
+
+// Answers every question about name with rcode
+func (s *testDNSServer) fail(name string, rcode dnsmessage.RCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcodes[name] = rcode
+}
+
+// How many questions were asked over TCP and with recursion desired
+func (s *testDNSServer) queries() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tcpQueries, s.recursiveQueries
+}
+
+func (s *testDNSServer) add(name string, qtype dnsmessage.Type, ttl uint32, body dnsmessage.ResourceBody) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(name) + " " + qtype.String()
+	s.records[key] = append(s.records[key], dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: body,
+	})
+}
+
+// The records answering a question, following CNAMEs
+func (s *testDNSServer) answer(question dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode) {
+	name := strings.ToLower(question.Name.String())
+	if rcode, ok := s.rcodes[name]; ok {
+		return nil, rcode
+	}
+	if cnames := s.records[name+" "+dnsmessage.TypeCNAME.String()]; len(cnames) > 0 && question.Type != dnsmessage.TypeCNAME {
+		question.Name = cnames[0].Body.(*dnsmessage.CNAMEResource).CNAME
+		answers, rcode := s.answer(question)
+		return append(append([]dnsmessage.Resource{}, cnames...), answers...), rcode
+	}
+	answers := s.records[name+" "+question.Type.String()]
+	if len(answers) == 0 {
+		for key := range s.records {
+			if strings.HasPrefix(key, name+" ") {
+				// The name exists, just not with this type
+				return nil, dnsmessage.RCodeSuccess
+			}
+		}
+		return nil, dnsmessage.RCodeNameError
+	}
+	return answers, dnsmessage.RCodeSuccess
+}
+
+// Responds to a request, truncating the response to udpSize unless that
+// is 0
+func (s *testDNSServer) respond(request []byte, tcp bool) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(request); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	s.mu.Lock()
+	if tcp {
+		s.tcpQueries++
+	}
+	if query.RecursionDesired {
+		s.recursiveQueries++
+	}
+	answers, rcode := s.answer(query.Questions[0])
+	// Packing writes the lengths into the records
+	answers = append([]dnsmessage.Resource{}, answers...)
+	s.mu.Unlock()
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+		Answers:   answers,
+	}
+	packed, _ := response.Pack()
+
+	udpSize := UDP_RESPONSE_SIZE
+	for _, additional := range query.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			udpSize = int(additional.Header.Class)
+		}
+	}
+	if !tcp && len(packed) > udpSize {
+		response.Truncated = true
+		response.Answers = nil
+		packed, _ = response.Pack()
+	}
+	return packed
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := s.respond(buf[:n], false); response != nil {
+			s.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *testDNSServer) serveTCP() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			request := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			response := s.respond(request, true)
+			binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+			conn.Write(append(length[:], response...))
+		}()
+	}
+}
+
+func TestWireQuerent(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+	server.add("_spf.example.com.", dnsmessage.TypeTXT, 3600, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ip4:192.0.2.0/24 ", "-all"}})
+	server.add("_spf.example.com.", dnsmessage.TypeTXT, 600, &dnsmessage.TXTResource{TXT: []string{"verification=abc"}})
+	server.add("example.com.", dnsmessage.TypeMX, 300, &dnsmessage.MXResource{Pref: 20, MX: dnsmessage.MustNewName("mx2.example.com.")})
+	server.add("example.com.", dnsmessage.TypeMX, 300, &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx1.example.com.")})
+	server.add("mail.example.com.", dnsmessage.TypeCNAME, 60, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("host.example.com.")})
+	server.add("host.example.com.", dnsmessage.TypeA, 900, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}})
+	server.add("host.example.com.", dnsmessage.TypeAAAA, 120, &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}})
+	server.add("10.2.0.192.in-addr.arpa.", dnsmessage.TypePTR, 300, &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("host.example.com.")})
+	server.fail("broken.example.com.", dnsmessage.RCodeServerFailure)
+
+	ctx := context.Background()
+	querent := NewWireQuerent(server.addr())
+
+	txts, ttl, err := querent.QueryTTL(ctx, "_spf.example.com")
+	if err != nil || len(txts) != 2 || txts[0] != "v=spf1 ip4:192.0.2.0/24 -all" || ttl != 10*time.Minute {
+		t.Errorf("Wrong TXT answer: %v %s %v", txts, ttl, err)
+	}
+
+	hosts, ttl, err := querent.QueryMXTTL(ctx, "example.com")
+	if err != nil || len(hosts) != 2 || hosts[0] != "mx1.example.com." || ttl != 5*time.Minute {
+		t.Errorf("Wrong MX answer: %v %s %v", hosts, ttl, err)
+	}
+
+	// The CNAME has the lowest TTL
+	ips, ttl, err := querent.QueryIPTTL(ctx, "mail.example.com")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.10")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) || ttl != time.Minute {
+		t.Errorf("Wrong IP answer: %v %s %v", ips, ttl, err)
+	}
+
+	names, err := querent.QueryPTR(ctx, "192.0.2.10")
+	if err != nil || len(names) != 1 || names[0] != "host.example.com." {
+		t.Errorf("Wrong PTR answer: %v %v", names, err)
+	}
+
+	if _, err := querent.Query(ctx, "missing.example.com"); !IsNotFound(err) {
+		t.Errorf("NXDOMAIN should be not found: %v", err)
+	}
+	// No TXT records at a name that exists
+	if _, err := querent.Query(ctx, "host.example.com"); !IsNotFound(err) {
+		t.Errorf("An empty answer should be not found: %v", err)
+	}
+	if _, err := querent.Query(ctx, "broken.example.com"); !IsTemporary(err) {
+		t.Errorf("SERVFAIL should be temporary: %v", err)
+	}
+}
+
+// Three records of 300 octets need more than 512 but less than 1232
+func addLargeTXT(server *testDNSServer) {
+	for _, c := range "abc" {
+		server.add("large.example.com.", dnsmessage.TypeTXT, 300, &dnsmessage.TXTResource{TXT: []string{strings.Repeat(string(c), 250), strings.Repeat(string(c), 50)}})
+	}
+}
+
+func TestWireQuerentTruncation(t *testing.T) {
+	server := newTestDNSServer(t)
+	defer server.close()
+	addLargeTXT(server)
+
+	ctx := context.Background()
+	querent := NewWireQuerent(server.addr())
+	txts, err := querent.Query(ctx, "large.example.com")
+	if err != nil || len(txts) != 3 || len(txts[0]) != 300 {
+		t.Errorf("Wrong EDNS0 answer: %v %v", txts, err)
+	}
+	if tcp, _ := server.queries(); tcp != 0 {
+		t.Errorf("The answer should fit the EDNS0 payload size, instead asked over TCP")
+	}
+
+	querent.UDPSize = UDP_RESPONSE_SIZE
+	txts, err = querent.Query(ctx, "large.example.com")
+	if err != nil || len(txts) != 3 || len(txts[2]) != 300 {
+		t.Errorf("Wrong TCP answer: %v %v", txts, err)
+	}
+	if tcp, _ := server.queries(); tcp != 1 {
+		t.Errorf("The truncated answer should be asked again over TCP, asked %d times", tcp)
+	}
+}
+
+func TestWireQuerentServers(t *testing.T) {
+	broken := newTestDNSServer(t)
+	defer broken.close()
+	broken.fail("_spf.example.com.", dnsmessage.RCodeServerFailure)
+	broken.fail("missing.example.com.", dnsmessage.RCodeServerFailure)
+	server := newTestDNSServer(t)
+	defer server.close()
+	server.add("_spf.example.com.", dnsmessage.TypeTXT, 300, &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}})
+	server.add("_spf2.example.com.", dnsmessage.TypeTXT, 300, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ~all"}})
+
+	ctx := context.Background()
+	querent := NewWireQuerent(broken.addr(), server.addr())
+	txts, err := querent.Query(ctx, "_spf.example.com")
+	if err != nil || len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Errorf("Should ask the next server after SERVFAIL: %v %v", txts, err)
+	}
+	// The first server doesn't know it exists either
+	if _, err := querent.Query(ctx, "missing.example.com"); !IsNotFound(err) {
+		t.Errorf("Should be not found: %v", err)
+	}
+	// NXDOMAIN is an answer, so the next server isn't asked
+	querent = NewWireQuerent(server.addr(), broken.addr())
+	if _, err := querent.Query(ctx, "missing.example.com"); !IsNotFound(err) {
+		t.Errorf("Should be not found: %v", err)
+	}
+}
+
+func TestWireQuerentAuthoritative(t *testing.T) {
+	recursive := newTestDNSServer(t)
+	defer recursive.close()
+	authoritative := newTestDNSServer(t)
+	defer authoritative.close()
+
+	// The resolver still has the record from before the vendor changed it
+	recursive.add("_spf.vendor.com.", dnsmessage.TypeTXT, 3600, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ip4:192.0.2.0/24 -all"}})
+	recursive.add("vendor.com.", dnsmessage.TypeNS, 86400, &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.vendor.com.")})
+	recursive.add("ns1.vendor.com.", dnsmessage.TypeA, 86400, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	authoritative.add("_spf.vendor.com.", dnsmessage.TypeTXT, 3600, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ip4:198.51.100.0/24 -all"}})
+	authoritative.add("mail.vendor.com.", dnsmessage.TypeCNAME, 300, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("_spf.vendor.com.")})
+
+	ctx := context.Background()
+	querent := NewWireQuerent(recursive.addr())
+	querent.Authoritative = true
+	querent.AuthoritativePort = authoritative.port()
+
+	txts, err := querent.Query(ctx, "_spf.vendor.com")
+	if err != nil || len(txts) != 1 || txts[0] != "v=spf1 ip4:198.51.100.0/24 -all" {
+		t.Errorf("Should get the record from the authoritative server: %v %v", txts, err)
+	}
+	txts, ttl, err := querent.QueryTTL(ctx, "mail.vendor.com")
+	if err != nil || len(txts) != 1 || ttl != 5*time.Minute {
+		t.Errorf("Should follow the CNAME: %v %s %v", txts, ttl, err)
+	}
+	if _, recursed := authoritative.queries(); recursed != 0 {
+		t.Errorf("Authoritative servers shouldn't be asked to recurse")
+	}
+	// NS for _spf.vendor.com, vendor.com and mail.vendor.com, and the
+	// IPv4 and IPv6 addresses of ns1.vendor.com only once
+	querent.Query(ctx, "_spf.vendor.com")
+	if _, recursed := recursive.queries(); recursed != 5 {
+		t.Errorf("Should remember the nameservers of vendor.com, asked the resolver %d questions", recursed)
+	}
+}
+
+func TestWireQuerentAuthorities(t *testing.T) {
+	recursive := newTestDNSServer(t)
+	defer recursive.close()
+	authoritative := newTestDNSServer(t)
+	defer authoritative.close()
+
+	recursive.add("example.com.", dnsmessage.TypeNS, 86400, &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")})
+	recursive.add("ns1.example.com.", dnsmessage.TypeA, 86400, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+
+	ctx := context.Background()
+	querent := NewWireQuerent(recursive.addr())
+	querent.AuthoritativePort = authoritative.port()
+	server := net.JoinHostPort("127.0.0.1", authoritative.port())
+
+	byServer, _, err := querent.QueryAuthoritiesTTL(ctx, "_spfABC.example.com")
+	if err != nil || len(byServer) != 1 || byServer[server] == nil || len(byServer[server]) != 0 {
+		t.Errorf("Should have no records on %s yet: %v %v", server, byServer, err)
+	}
+
+	authoritative.add("_spfABC.example.com.", dnsmessage.TypeTXT, 300, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ip4:192.0.2.0/24 ~all"}})
+	byServer, ttl, err := querent.QueryAuthoritiesTTL(ctx, "_spfABC.example.com")
+	if err != nil || len(byServer[server]) != 1 || byServer[server][0] != "v=spf1 ip4:192.0.2.0/24 ~all" || ttl != 5*time.Minute {
+		t.Errorf("Should have the new record on %s: %v %s %v", server, byServer, ttl, err)
+	}
+}
+
+func TestWireQuerentIPv6Nameservers(t *testing.T) {
+	recursive := newTestDNSServer(t)
+	defer recursive.close()
+	recursive.add("example.com.", dnsmessage.TypeNS, 86400, &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")})
+	recursive.add("example.com.", dnsmessage.TypeNS, 86400, &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns2.example.com.")})
+	recursive.add("ns1.example.com.", dnsmessage.TypeA, 86400, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}})
+	recursive.add("ns2.example.com.", dnsmessage.TypeAAAA, 86400, &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x53}})
+
+	servers, err := NewWireQuerent(recursive.addr()).authorities(context.Background(), "_spf.example.com")
+	expected := []string{"192.0.2.53:53", "[2001:db8::53]:53"}
+	if err != nil || strings.Join(servers, " ") != strings.Join(expected, " ") {
+		t.Errorf("Should find nameservers with only an IPv6 address too: %v %v", servers, err)
+	}
+}
+
+func TestWireQuerentTimeout(t *testing.T) {
+	// Never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	querent := NewWireQuerent(conn.LocalAddr().String())
+	querent.Timeout = 20 * time.Millisecond
+	start := time.Now()
+	_, err = querent.Query(context.Background(), "_spf.example.com")
+	if !IsTemporary(err) || time.Since(start) > time.Second {
+		t.Errorf("Should give up on a lost reply without a deadline, got %v after %s", err, time.Since(start))
+	}
+}